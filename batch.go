@@ -0,0 +1,134 @@
+package kv
+
+import (
+	"context"
+	stderr "errors"
+	"fmt"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/roadrunner-server/errors"
+	"go.opentelemetry.io/otel/codes"
+)
+
+var errUnknownOp = stderr.New("unknown batch operation")
+
+// BatchOp is a single operation of the batch. Op is one of has, get, mget, set,
+// setnx, setxx, mexpire, ttl, delete or clear.
+type BatchOp struct {
+	Op      string       `json:"op"`
+	Storage string       `json:"storage"`
+	Items   []*kvV1.Item `json:"items,omitempty"`
+}
+
+// BatchRequest is the payload of the kv.Batch RPC call.
+type BatchRequest struct {
+	Ops []*BatchOp `json:"ops"`
+	// StopOnError skips the operations following the first failed one
+	StopOnError bool     `json:"stop_on_error,omitempty"`
+	Metadata    Metadata `json:"metadata,omitempty"`
+}
+
+// BatchResult is the outcome of a single operation, in the same shape as the
+// response of the corresponding RPC call.
+type BatchResult struct {
+	Items []*kvV1.Item `json:"items,omitempty"`
+	Error string       `json:"error,omitempty"`
+	// Code is the code of the Error
+	Code Code `json:"code,omitempty"`
+	// Skipped is set for the operations not executed because of StopOnError
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// BatchResponse holds one result per requested operation, in the request order.
+type BatchResponse struct {
+	Results []*BatchResult `json:"results"`
+}
+
+// Batch executes the operations in order, within a single round trip. Failed
+// operations are reported in their results, so the call itself doesn't fail.
+func (r *rpc) Batch(in *BatchRequest, out *BatchResponse) error {
+	const op = errors.Op("rpc_batch")
+
+	ctx, span := r.tracer.Start(contextFrom(in.Metadata), "kv:batch")
+	defer span.End()
+
+	// the client timeout bounds the batch as a whole
+	ctx, cancel, err := withClientTimeout(ctx, in.Metadata)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	out.Results = make([]*BatchResult, 0, len(in.Ops))
+
+	failed := false
+	for _, bop := range in.Ops {
+		if failed && in.StopOnError {
+			out.Results = append(out.Results, &BatchResult{Skipped: true})
+			continue
+		}
+
+		res := &BatchResult{}
+		out.Results = append(out.Results, res)
+
+		call := r.batchOp(bop.Op)
+		if call == nil {
+			err := fmt.Errorf("%w: %s", errUnknownOp, bop.Op)
+			recordError(span, err)
+			res.Error = withCode(err).Error()
+			res.Code = codeOf(err)
+			failed = true
+			continue
+		}
+
+		var resp kvV1.Response
+		// every operation starts its own child span
+		err := call(ctx, &kvV1.Request{Storage: bop.Storage, Items: bop.Items}, &resp)
+		if err != nil {
+			res.Error = err.Error()
+			res.Code = codeOf(err)
+			failed = true
+			continue
+		}
+
+		res.Items = resp.GetItems()
+	}
+
+	if failed {
+		span.SetStatus(codes.Error, "one or more batch operations failed")
+	}
+
+	return nil
+}
+
+func (r *rpc) batchOp(name string) func(ctx context.Context, in *kvV1.Request, out *kvV1.Response) error {
+	switch name {
+	case "has":
+		return r.has
+	case "get":
+		return r.get
+	case "mget":
+		return r.mget
+	case "set":
+		return r.set
+	case "setnx":
+		return func(ctx context.Context, in *kvV1.Request, out *kvV1.Response) error {
+			return r.setIf(ctx, in, out, true)
+		}
+	case "setxx":
+		return func(ctx context.Context, in *kvV1.Request, out *kvV1.Response) error {
+			return r.setIf(ctx, in, out, false)
+		}
+	case "mexpire":
+		return r.mexpire
+	case "ttl":
+		return r.ttl
+	case "delete":
+		return r.del
+	case "clear":
+		return r.clear
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,89 @@
+package kv
+
+import (
+	stderr "errors"
+	"testing"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+)
+
+func TestRPCBatch(t *testing.T) {
+	st := newMemStorage()
+	st.put(firstKey, "a", "")
+	r, rec := newRPC(t, st)
+
+	var out BatchResponse
+	require.NoError(t, r.Batch(&BatchRequest{Ops: []*BatchOp{
+		{Op: "set", Storage: servedStorage, Items: []*kvV1.Item{{Key: secondKey, Value: []byte("b")}}},
+		{Op: "has", Storage: servedStorage, Items: []*kvV1.Item{{Key: secondKey}}},
+		{Op: "get", Storage: servedStorage, Items: []*kvV1.Item{{Key: firstKey}}},
+		{Op: "setnx", Storage: servedStorage, Items: twoItems()},
+	}}, &out))
+
+	require.Len(t, out.Results, 4)
+	for _, res := range out.Results {
+		assert.Empty(t, res.Error)
+	}
+
+	assert.Equal(t, []*kvV1.Item{{Key: secondKey}}, out.Results[1].Items)
+	assert.Equal(t, []*kvV1.Item{{Key: firstKey, Value: []byte("a")}}, out.Results[2].Items)
+	// both keys exist by the time setnx runs
+	assert.Empty(t, out.Results[3].Items)
+
+	// every operation is a child of the batch span
+	ended := rec.Ended()
+	require.Len(t, ended, 5)
+	parent := ended[4]
+	assert.Equal(t, "kv:batch", parent.Name())
+	for i, name := range []string{"kv:set", "kv:has", "kv:get", "kv:setnx"} {
+		assert.Equal(t, name, ended[i].Name())
+		assert.Equal(t, parent.SpanContext().SpanID(), ended[i].Parent().SpanID())
+	}
+}
+
+func TestRPCBatchErrors(t *testing.T) {
+	cases := []struct {
+		name        string
+		stopOnError bool
+		want        []bool // whether the result of each op is skipped
+	}{
+		{name: "continue after errors", want: []bool{false, false, false, false}},
+		{name: "stop on the first error", stopOnError: true, want: []bool{false, true, true, true}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, rec := newRPC(t, &fakeStorage{err: stderr.New("driver is unhappy")})
+
+			var out BatchResponse
+			require.NoError(t, r.Batch(&BatchRequest{StopOnError: tc.stopOnError, Ops: []*BatchOp{
+				{Op: "clear", Storage: "ghost"},
+				{Op: "unknown", Storage: servedStorage},
+				{Op: "mget", Storage: servedStorage, Items: twoItems()},
+				{Op: "clear", Storage: servedStorage},
+			}}, &out))
+
+			require.Len(t, out.Results, 4)
+			skipped := make([]bool, 0, len(out.Results))
+			for _, res := range out.Results {
+				skipped = append(skipped, res.Skipped)
+			}
+			assert.Equal(t, tc.want, skipped)
+
+			assert.Contains(t, out.Results[0].Error, "no such storage: ghost")
+			if !tc.stopOnError {
+				assert.Contains(t, out.Results[1].Error, errUnknownOp.Error())
+				assert.Contains(t, out.Results[2].Error, "driver is unhappy")
+				assert.Contains(t, out.Results[3].Error, "rpc_clear")
+			}
+
+			ended := rec.Ended()
+			parent := ended[len(ended)-1]
+			assert.Equal(t, "kv:batch", parent.Name())
+			assert.Equal(t, codes.Error, parent.Status().Code)
+		})
+	}
+}
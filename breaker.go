@@ -0,0 +1,169 @@
+package kv
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of the circuit breaker of a failover storage.
+type BreakerState string
+
+const (
+	// BreakerClosed - the calls go to the primary, its failures are counted
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen - the calls go to the fallback until the open timeout passes
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen - a few probe calls go to the primary, the rest to the fallback
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// breaker is a circuit breaker. It opens after the number of consecutive
+// failures, stays open for the timeout and then lets the probes through: the
+// breaker closes once that many probes succeed and opens again on the first
+// failed one.
+type breaker struct {
+	// failures open the closed breaker
+	failures int
+	// openTimeout is the time the breaker stays open before the probes
+	openTimeout time.Duration
+	// probes is the number of the successful probes closing the breaker, and the
+	// number of the probes running at once
+	probes int
+	// onChange is called on every transition, outside the lock
+	onChange func(ctx context.Context, from, to BreakerState, err error)
+	now      func() time.Time
+
+	mu    sync.Mutex
+	state BreakerState
+	// gen is incremented on every transition, the outcome of a call allowed in
+	// an earlier generation is ignored
+	gen uint64
+	// consecutive counts the failures in the closed state
+	consecutive int
+	// succeeded and inflight count the probes in the half-open state
+	succeeded int
+	inflight  int
+	openedAt  time.Time
+	lastErr   error
+}
+
+func newBreaker(failures int, openTimeout time.Duration, probes int, onChange func(ctx context.Context, from, to BreakerState, err error)) *breaker {
+	return &breaker{
+		failures:    failures,
+		openTimeout: openTimeout,
+		probes:      probes,
+		onChange:    onChange,
+		now:         time.Now,
+		state:       BreakerClosed,
+	}
+}
+
+// allow reports whether the call may go to the primary and the generation the
+// outcome of the call should be reported with. The open breaker turns half-open
+// once the open timeout passes.
+func (b *breaker) allow(ctx context.Context) (bool, uint64) {
+	b.mu.Lock()
+
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.openTimeout {
+		b.moveTo(BreakerHalfOpen)
+		b.mu.Unlock()
+		b.onChange(ctx, BreakerOpen, BreakerHalfOpen, nil)
+		b.mu.Lock()
+	}
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerClosed:
+		return true, b.gen
+	case BreakerHalfOpen:
+		if b.inflight < b.probes {
+			b.inflight++
+			return true, b.gen
+		}
+	}
+
+	return false, 0
+}
+
+// done records the outcome of the call allowed to the primary in the generation.
+func (b *breaker) done(ctx context.Context, gen uint64, err error) {
+	b.mu.Lock()
+
+	from := b.state
+	switch {
+	// a call which started before the breaker opened, or the probe of an earlier
+	// half-open cycle
+	case gen != b.gen:
+	case b.state == BreakerHalfOpen:
+		b.inflight--
+		switch {
+		// neither a failure nor a success
+		case !tripping(err) && err != nil:
+		case err != nil:
+			b.open(err)
+		default:
+			b.succeeded++
+			if b.succeeded >= b.probes {
+				b.moveTo(BreakerClosed)
+			}
+		}
+	case !tripping(err) && err != nil:
+	case err != nil:
+		b.consecutive++
+		b.lastErr = err
+		if b.consecutive >= b.failures {
+			b.open(err)
+		}
+	default:
+		b.consecutive = 0
+	}
+
+	to := b.state
+	b.mu.Unlock()
+
+	if from != to {
+		b.onChange(ctx, from, to, err)
+	}
+}
+
+func (b *breaker) open(err error) {
+	b.moveTo(BreakerOpen)
+	b.openedAt = b.now()
+	b.lastErr = err
+}
+
+// moveTo switches the breaker to the state, starting a new generation.
+func (b *breaker) moveTo(state BreakerState) {
+	b.state = state
+	b.gen++
+
+	switch state {
+	case BreakerHalfOpen:
+		b.succeeded, b.inflight = 0, 0
+	case BreakerClosed:
+		b.consecutive = 0
+	}
+}
+
+// breakerSnapshot is the state of the breaker at a moment.
+type breakerSnapshot struct {
+	state       BreakerState
+	consecutive int
+	openedAt    time.Time
+	lastErr     error
+}
+
+func (b *breaker) snapshot() breakerSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return breakerSnapshot{state: b.state, consecutive: b.consecutive, openedAt: b.openedAt, lastErr: b.lastErr}
+}
+
+// tripping reports whether the error of the primary counts as its failure: the
+// primary is unavailable or timed out. The other errors, for example an invalid
+// argument or a call canceled by the caller, are neither failures nor successes.
+func tripping(err error) bool {
+	return unreachable(err)
+}
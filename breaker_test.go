@@ -0,0 +1,116 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// errDown is the error of an unreachable primary.
+var errDown = fmt.Errorf("%w: connection refused", ErrUnavailable)
+
+func TestBreakerTransitions(t *testing.T) {
+	var transitions []BreakerState
+	b := newBreaker(2, time.Minute, 2, func(_ context.Context, _, to BreakerState, _ error) {
+		transitions = append(transitions, to)
+	})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	call := func(err error) {
+		ok, gen := b.allow(ctx)
+		if ok {
+			b.done(ctx, gen, err)
+		}
+	}
+
+	// a success resets the consecutive failures
+	call(errDown)
+	call(nil)
+	call(errDown)
+	assert.Equal(t, BreakerClosed, b.snapshot().state)
+
+	call(errDown)
+	assert.Equal(t, BreakerOpen, b.snapshot().state)
+	ok, _ := b.allow(ctx)
+	assert.False(t, ok)
+
+	// the probes run once the open timeout passes, up to the limit at once
+	now = now.Add(time.Minute)
+	ok, first := b.allow(ctx)
+	assert.True(t, ok)
+	ok, second := b.allow(ctx)
+	assert.True(t, ok)
+	ok, _ = b.allow(ctx)
+	assert.False(t, ok)
+	assert.Equal(t, BreakerHalfOpen, b.snapshot().state)
+
+	// a failed probe opens the breaker again
+	b.done(ctx, first, nil)
+	b.done(ctx, second, errDown)
+	assert.Equal(t, BreakerOpen, b.snapshot().state)
+
+	// the probes close it once enough of them succeed
+	now = now.Add(time.Minute)
+	call(nil)
+	assert.Equal(t, BreakerHalfOpen, b.snapshot().state)
+	call(nil)
+	assert.Equal(t, BreakerClosed, b.snapshot().state)
+
+	assert.Equal(t, []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}, transitions)
+}
+
+func TestBreakerIgnoresCallerErrors(t *testing.T) {
+	b := newBreaker(1, time.Minute, 1, func(context.Context, BreakerState, BreakerState, error) {})
+	ctx := context.Background()
+
+	ok, gen := b.allow(ctx)
+	assert.True(t, ok)
+	for _, err := range []error{context.Canceled, fmt.Errorf("%w: empty key", ErrInvalidArgument), assert.AnError} {
+		b.done(ctx, gen, err)
+		assert.Equal(t, BreakerClosed, b.snapshot().state, err)
+	}
+
+	b.done(ctx, gen, context.DeadlineExceeded)
+	assert.Equal(t, BreakerOpen, b.snapshot().state)
+}
+
+func TestBreakerIgnoresStaleCalls(t *testing.T) {
+	b := newBreaker(1, time.Minute, 1, func(context.Context, BreakerState, BreakerState, error) {})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// a call started in the closed state doesn't reopen the open breaker
+	_, closed := b.allow(ctx)
+	_, other := b.allow(ctx)
+	b.done(ctx, other, errDown)
+	openedAt := b.snapshot().openedAt
+	now = now.Add(time.Second)
+	b.done(ctx, closed, errDown)
+	assert.Equal(t, openedAt, b.snapshot().openedAt)
+
+	// the probe of the first half-open cycle, finishing in the second one, takes
+	// no probe slot of the second cycle
+	now = now.Add(time.Minute)
+	ok, stale := b.allow(ctx)
+	assert.True(t, ok)
+	b.mu.Lock()
+	b.open(errDown)
+	b.mu.Unlock()
+
+	now = now.Add(time.Minute)
+	ok, probe := b.allow(ctx)
+	assert.True(t, ok)
+	b.done(ctx, stale, nil)
+	ok, _ = b.allow(ctx)
+	assert.False(t, ok)
+	assert.Equal(t, BreakerHalfOpen, b.snapshot().state)
+
+	b.done(ctx, probe, nil)
+	assert.Equal(t, BreakerClosed, b.snapshot().state)
+}
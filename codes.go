@@ -0,0 +1,179 @@
+package kv
+
+import (
+	"context"
+	stderr "errors"
+	"fmt"
+	"net"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// Code is the stable code of an RPC error. Clients branch on the code instead of
+// matching the error message.
+type Code string
+
+const (
+	// CodeStorageNotFound - the requested storage is not configured
+	CodeStorageNotFound Code = "storage_not_found"
+	// CodeKeyNotFound - the operation requires an existing key
+	CodeKeyNotFound Code = "key_not_found"
+	// CodeUnavailable - the storage backend can't be reached
+	CodeUnavailable Code = "unavailable"
+	// CodeTimeout - the storage didn't answer in time
+	CodeTimeout Code = "timeout"
+	// CodeInvalidTTL - the item timeout or the TTL is malformed
+	CodeInvalidTTL Code = "invalid_ttl"
+	// CodeInvalidArgument - the request is malformed
+	CodeInvalidArgument Code = "invalid_argument"
+	// CodeUnsupported - the storage driver doesn't support the operation
+	CodeUnsupported Code = "unsupported"
+	// CodeConflict - the request conflicts with the current state, for example the storage already exists
+	CodeConflict Code = "conflict"
+	// CodeAborted - the item was not attempted, because another item of the request was rejected
+	CodeAborted Code = "aborted"
+	// CodeInternal - any other error
+	CodeInternal Code = "internal"
+)
+
+// Sentinel errors of the error codes. Drivers wrap them, for example with
+// fmt.Errorf("%w: %s", kv.ErrUnavailable, err), to report the code of a failure.
+var (
+	ErrKeyNotFound     = stderr.New("key not found")
+	ErrUnavailable     = stderr.New("storage is unavailable")
+	ErrTimeout         = stderr.New("storage operation timed out")
+	ErrInvalidTTL      = stderr.New("invalid ttl")
+	ErrInvalidArgument = stderr.New("invalid argument")
+	ErrUnsupported     = stderr.New("operation is not supported by the storage driver")
+)
+
+// errorCodes maps the errors to their codes, the first match wins.
+var errorCodes = []struct {
+	err  error
+	code Code
+}{
+	{err: errNoSuchStore, code: CodeStorageNotFound},
+	{err: ErrKeyNotFound, code: CodeKeyNotFound},
+	{err: ErrUnavailable, code: CodeUnavailable},
+	{err: ErrTimeout, code: CodeTimeout},
+	{err: context.DeadlineExceeded, code: CodeTimeout},
+	{err: ErrInvalidTTL, code: CodeInvalidTTL},
+	{err: errLockTTL, code: CodeInvalidTTL},
+	{err: ErrInvalidArgument, code: CodeInvalidArgument},
+	{err: errEmptyStorage, code: CodeInvalidArgument},
+	{err: errSingleKey, code: CodeInvalidArgument},
+	{err: errClientTimeout, code: CodeInvalidArgument},
+	{err: errEmptyResource, code: CodeInvalidArgument},
+	{err: errEmptyOwner, code: CodeInvalidArgument},
+	{err: errNotInteger, code: CodeInvalidArgument},
+	{err: errCounterOverflow, code: CodeInvalidArgument},
+	{err: errUnknownOp, code: CodeInvalidArgument},
+	{err: errBadPattern, code: CodeInvalidArgument},
+	{err: ErrUnsupported, code: CodeUnsupported},
+	{err: errConfigReload, code: CodeUnsupported},
+	{err: errStorageExists, code: CodeConflict},
+	{err: errAborted, code: CodeAborted},
+}
+
+// Error is the error returned by the RPC methods. Its message starts with the
+// code in square brackets, so the code survives the transport as a part of the
+// error string:
+//
+//	[storage_not_found] rpc_mget: no such storage: ghost
+type Error struct {
+	Code Code
+	op   errors.Op
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.op == "" {
+		return fmt.Sprintf("[%s] %v", e.Code, e.Err)
+	}
+
+	return fmt.Sprintf("[%s] %s: %v", e.Code, e.op, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// rpcError wraps the error of the RPC method with its code and the operation.
+func rpcError(op errors.Op, err error) error {
+	return &Error{Code: codeOf(err), op: op, Err: err}
+}
+
+// withCode wraps the error of the RPC method with its code only.
+func withCode(err error) error {
+	return &Error{Code: codeOf(err), Err: err}
+}
+
+// codeOf returns the code of the error. The network errors of the drivers are
+// reported as unavailable, or timeout when they are timeouts.
+func codeOf(err error) Code {
+	chain := unwrapAll(err)
+	for _, e := range chain {
+		if coded, ok := e.(*Error); ok {
+			return coded.Code
+		}
+	}
+
+	for _, c := range errorCodes {
+		for _, e := range chain {
+			if stderr.Is(e, c.err) {
+				return c.code
+			}
+		}
+	}
+
+	for _, e := range chain {
+		if nerr, ok := e.(net.Error); ok {
+			if nerr.Timeout() {
+				return CodeTimeout
+			}
+			return CodeUnavailable
+		}
+	}
+
+	return CodeInternal
+}
+
+// unwrapAll returns the errors of the tree rooted at err, depth first. Besides the
+// standard wrapping, it walks into the *errors.Error the drivers wrap their
+// failures with, which doesn't implement Unwrap.
+func unwrapAll(err error) []error {
+	var chain []error
+
+	var walk func(e error)
+	walk = func(e error) {
+		if e == nil {
+			return
+		}
+		chain = append(chain, e)
+
+		switch x := e.(type) {
+		case *errors.Error:
+			walk(x.Err)
+		case interface{ Unwrap() error }:
+			walk(x.Unwrap())
+		case interface{ Unwrap() []error }:
+			for _, e := range x.Unwrap() {
+				walk(e)
+			}
+		}
+	}
+	walk(err)
+
+	return chain
+}
+
+// unreachable reports whether the error tells the storage can't serve the calls
+// at the moment, whatever they carry: it's unavailable or it timed out.
+func unreachable(err error) bool {
+	switch codeOf(err) {
+	case CodeUnavailable, CodeTimeout:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,98 @@
+package kv
+
+import (
+	"context"
+	stderr "errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/roadrunner-server/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodeOf(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		code Code
+	}{
+		{name: "unknown storage", err: fmt.Errorf("%w: ghost", errNoSuchStore), code: CodeStorageNotFound},
+		{name: "driver missing key", err: fmt.Errorf("%w: alpha", ErrKeyNotFound), code: CodeKeyNotFound},
+		{name: "driver unavailable", err: fmt.Errorf("%w: pool exhausted", ErrUnavailable), code: CodeUnavailable},
+		{name: "gateway timeout", err: fmt.Errorf("%w: south", ErrTimeout), code: CodeTimeout},
+		{name: "context deadline", err: context.DeadlineExceeded, code: CodeTimeout},
+		{name: "driver ttl", err: fmt.Errorf("%w: yesterday", ErrInvalidTTL), code: CodeInvalidTTL},
+		{name: "lock ttl", err: errLockTTL, code: CodeInvalidTTL},
+		{name: "empty storage", err: errEmptyStorage, code: CodeInvalidArgument},
+		{name: "unsupported", err: fmt.Errorf("%w: scan", ErrUnsupported), code: CodeUnsupported},
+		{name: "storage exists", err: errStorageExists, code: CodeConflict},
+		{name: "aborted item", err: errAborted, code: CodeAborted},
+		{
+			name: "refused connection",
+			err:  &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", stderr.New("connection refused"))},
+			code: CodeUnavailable,
+		},
+		{name: "network timeout", err: &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, code: CodeTimeout},
+		{name: "coded error", err: &Error{Code: CodeConflict, Err: stderr.New("busy")}, code: CodeConflict},
+		{
+			name: "driver wrapped network error",
+			err:  errors.E(errors.Op("redis_get"), &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", stderr.New("connection refused"))}),
+			code: CodeUnavailable,
+		},
+		{name: "driver wrapped deadline", err: errors.E(errors.Op("redis_get"), context.DeadlineExceeded), code: CodeTimeout},
+		{
+			name: "nested driver errors",
+			err:  fmt.Errorf("shard a: %w", errors.E(errors.Op("mget"), errors.E(errors.Op("redis_mget"), fmt.Errorf("%w: pool", ErrUnavailable)))),
+			code: CodeUnavailable,
+		},
+		{name: "joined errors", err: stderr.Join(stderr.New("oops"), fmt.Errorf("%w: south", ErrTimeout)), code: CodeTimeout},
+		{name: "anything else", err: stderr.New("oops"), code: CodeInternal},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.code, codeOf(tc.err))
+		})
+	}
+}
+
+func TestRPCErrorCodes(t *testing.T) {
+	r, _ := newRPC(t, &fakeStorage{err: fmt.Errorf("%w: no connection", ErrUnavailable)})
+
+	err := r.MGet(&kvV1.Request{Storage: "ghost", Items: twoItems()}, &kvV1.Response{})
+	assert.EqualError(t, err, "[storage_not_found] no such storage: ghost")
+
+	err = r.Has(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &kvV1.Response{})
+	assert.EqualError(t, err, "[unavailable] rpc_has: storage is unavailable: no connection")
+
+	var coded *Error
+	require.ErrorAs(t, err, &coded)
+	assert.Equal(t, CodeUnavailable, coded.Code)
+	// the chain stays inspectable
+	assert.ErrorIs(t, err, ErrUnavailable)
+
+	err = r.Get(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &kvV1.Response{})
+	assert.EqualError(t, err, "[invalid_argument] rpc_get: exactly one key should be provided")
+}
+
+func TestRPCBatchErrorCodes(t *testing.T) {
+	r, _ := newRPC(t, newMemStorage())
+
+	var out BatchResponse
+	require.NoError(t, r.Batch(&BatchRequest{Ops: []*BatchOp{
+		{Op: "has", Storage: "ghost", Items: twoItems()},
+		{Op: "rename", Storage: servedStorage},
+		{Op: "set", Storage: servedStorage, Items: twoItems()},
+	}}, &out))
+
+	require.Len(t, out.Results, 3)
+	assert.Equal(t, CodeStorageNotFound, out.Results[0].Code)
+	assert.Equal(t, "[storage_not_found] no such storage: ghost", out.Results[0].Error)
+	assert.Equal(t, CodeInvalidArgument, out.Results[1].Code)
+	assert.Equal(t, "[invalid_argument] unknown batch operation: rename", out.Results[1].Error)
+	assert.Empty(t, out.Results[2].Code)
+}
@@ -0,0 +1,127 @@
+package kv
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"slices"
+	"sort"
+
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/roadrunner-server/errors"
+)
+
+// sourceComposite marks the storages built by the plugin on top of other storages
+const sourceComposite string = "composite"
+
+// compositeSpec is the parsed section of a composite storage.
+type compositeSpec interface {
+	// refs lists the names of the storages the composite is built on
+	refs() []string
+	// build constructs the composite on top of the referenced storages, passed in
+	// the refs order
+	build(env *compositeEnv, tiers []kv.Storage) (kv.Storage, error)
+}
+
+// compositeEnv is what the composites get from the plugin.
+type compositeEnv struct {
+	// name of the composite storage
+	name string
+	// log carries the name of the composite storage
+	log     *slog.Logger
+	metrics *metrics
+}
+
+// composites are the drivers implemented by the plugin itself, on top of the
+// storages declared in the same kv section. They work with any driver.
+var composites = map[string]func(name string, section map[string]any) (compositeSpec, error){
+	tieredDriver:   parseTiered,
+	mirrorDriver:   parseMirror,
+	shardedDriver:  parseSharded,
+	failoverDriver: parseFailover,
+}
+
+// compositeSection is a composite storage waiting for the storages it references.
+type compositeSection struct {
+	info    *StorageInfo
+	opts    *storageOptions
+	section []any
+	spec    compositeSpec
+}
+
+// constructComposites builds the composite storages once the storages they
+// reference are built, so that composites may be stacked. A composite is reused
+// when neither its section nor the storages it references changed.
+func (p *Plugin) constructComposites(storages map[string]*storageEntry, pending []*compositeSection, running map[string]*storageEntry) error {
+	for len(pending) > 0 {
+		waiting := make(map[string]struct{}, len(pending))
+		for _, cs := range pending {
+			waiting[cs.info.Name] = struct{}{}
+		}
+
+		left := make([]*compositeSection, 0, len(pending))
+		for _, cs := range pending {
+			deps := make([]*storageEntry, 0, len(cs.spec.refs()))
+			for _, ref := range cs.spec.refs() {
+				if dep, ok := storages[ref]; ok {
+					deps = append(deps, dep)
+					continue
+				}
+
+				if _, ok := waiting[ref]; !ok {
+					return errors.Errorf("the %s storage references the %s storage, which is not declared or was skipped", cs.info.Name, ref)
+				}
+			}
+
+			if len(deps) < len(cs.spec.refs()) {
+				left = append(left, cs)
+				continue
+			}
+
+			name := cs.info.Name
+			if old, ok := running[name]; ok && *old.info == *cs.info && reflect.DeepEqual(old.section, cs.section) && slices.Equal(old.deps, deps) {
+				storages[name] = old
+				continue
+			}
+
+			tiers := make([]kv.Storage, 0, len(deps))
+			for _, dep := range deps {
+				tiers = append(tiers, dep.Storage)
+			}
+
+			env := &compositeEnv{name: name, log: p.log.With("storage", name), metrics: p.metrics}
+			st, err := cs.spec.build(env, tiers)
+			if err != nil {
+				return err
+			}
+
+			entry := p.newEntry(st, cs.info, cs.opts, cs.section)
+			// the referenced storages keep running as long as the composite does
+			entry.deps = deps
+			for _, dep := range deps {
+				dep.hold()
+			}
+			storages[name] = entry
+		}
+
+		if len(left) == len(pending) {
+			names := make([]string, 0, len(left))
+			for _, cs := range left {
+				names = append(names, cs.info.Name)
+			}
+			sort.Strings(names)
+
+			return errors.Errorf("the composite storages reference each other: %v", names)
+		}
+
+		pending = left
+	}
+
+	return nil
+}
+
+// stopNothing is embedded by the composites: the storages they are built on are
+// stopped by their own entries.
+type stopNothing struct{}
+
+func (stopNothing) Stop(context.Context) {}
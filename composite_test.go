@@ -0,0 +1,119 @@
+package kv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompositeConstruction(t *testing.T) {
+	cases := []struct {
+		name string
+		data map[string]any
+		err  string
+	}{
+		{
+			name: "stacked composites",
+			data: map[string]any{
+				"a":      map[string]any{"driver": "fake"},
+				"b":      map[string]any{"driver": "fake"},
+				"c":      map[string]any{"driver": "fake"},
+				"inner":  map[string]any{"driver": "tiered", "near": "a", "far": "b"},
+				"outer":  map[string]any{"driver": "tiered", "near": "c", "far": "inner"},
+				"unused": map[string]any{"driver": "fake"},
+			},
+		},
+		{
+			name: "unknown reference",
+			data: map[string]any{
+				"a":     map[string]any{"driver": "fake"},
+				"users": map[string]any{"driver": "tiered", "near": "a", "far": "ghost"},
+			},
+			err: "the users storage references the ghost storage",
+		},
+		{
+			name: "cycle",
+			data: map[string]any{
+				"a": map[string]any{"driver": "fake"},
+				"x": map[string]any{"driver": "tiered", "near": "a", "far": "y"},
+				"y": map[string]any{"driver": "tiered", "near": "a", "far": "x"},
+			},
+			err: "the composite storages reference each other: [x y]",
+		},
+		{
+			name: "missing tier",
+			data: map[string]any{
+				"a":     map[string]any{"driver": "fake"},
+				"users": map[string]any{"driver": "tiered", "near": "a"},
+			},
+			err: "the users storage should reference its far tier",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, _ := newInitedPlugin(t, tc.data, nil)
+			ctor := &fakeConstructor{name: "fake"}
+			p.Collects()[0].Callback(ctor)
+
+			err := serveErr(p.Serve())
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+				// the storages built before the failure are stopped
+				for _, st := range ctor.created {
+					assert.Equal(t, 1, st.recorded().stopCalls)
+				}
+				return
+			}
+			require.NoError(t, err)
+
+			storages := p.storages.snapshot()
+			require.Len(t, storages, len(tc.data))
+			assert.Equal(t, sourceComposite, storages["outer"].info.Source)
+			assert.Equal(t, []*storageEntry{storages["c"], storages["inner"]}, storages["outer"].deps)
+		})
+	}
+}
+
+func TestCompositeReload(t *testing.T) {
+	c := &mockCfg{
+		data: map[string]any{
+			"north": map[string]any{"driver": "fake"},
+			"south": map[string]any{"driver": "fake", "config": map[string]any{"size": 1}},
+			"users": map[string]any{"driver": "tiered", "near": "north", "far": "south"},
+		},
+		has: map[string]bool{PluginName: true, "kv.south.config": true},
+	}
+	p, _ := servedFake(t, c)
+
+	before := p.storages.snapshot()
+	r, ok := p.RPC().(*rpc)
+	require.True(t, ok)
+
+	// nothing changed, the composite is reused
+	var out ReloadResponse
+	require.NoError(t, r.Reload(true, &out))
+	assert.Equal(t, []string{"north", "south", "users"}, out.Unchanged)
+
+	// the composite is rebuilt on top of the replaced storage
+	c.data["south"] = map[string]any{"driver": "fake", "config": map[string]any{"size": 2}}
+	out = ReloadResponse{}
+	require.NoError(t, r.Reload(true, &out))
+	assert.Equal(t, []string{"south", "users"}, out.Replaced)
+	assert.Equal(t, []string{"north"}, out.Unchanged)
+
+	after := p.storages.snapshot()
+	assert.Equal(t, []*storageEntry{after["north"], after["south"]}, after["users"].deps)
+	<-before["users"].stopped
+	<-before["south"].stopped
+	assert.Equal(t, 1, before["south"].Storage.(*fakeStorage).recorded().stopCalls)
+
+	// the referenced storages are stopped along with the composite
+	require.NoError(t, p.Stop(context.Background()))
+	for _, entry := range after {
+		<-entry.stopped
+	}
+	assert.Equal(t, 1, after["north"].Storage.(*fakeStorage).recorded().stopCalls)
+}
@@ -0,0 +1,295 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/roadrunner-server/errors"
+)
+
+// ConditionalWriter is an optional capability of the kv.Storage. Drivers
+// implementing it check the condition and write the item atomically on the
+// backend side.
+type ConditionalWriter interface {
+	// SetNX stores only the items whose keys are missing and returns the written keys.
+	SetNX(ctx context.Context, items ...kv.Item) ([]string, error)
+	// SetXX stores only the items whose keys exist and returns the written keys.
+	SetXX(ctx context.Context, items ...kv.Item) ([]string, error)
+	// CompareAndSwap stores the item only when the key exists and its current value
+	// equals expected. It reports whether the item was written.
+	CompareAndSwap(ctx context.Context, item kv.Item, expected []byte) (bool, error)
+}
+
+// CASItem is a single compare-and-swap operation.
+type CASItem struct {
+	Key     string `json:"key"`
+	Value   []byte `json:"value"`
+	Timeout string `json:"timeout,omitempty"`
+	// Expected is the value the key should hold for the swap to happen
+	Expected []byte `json:"expected"`
+}
+
+// CASRequest is the payload of the kv.CompareAndSwap RPC call.
+type CASRequest struct {
+	Storage  string     `json:"storage"`
+	Items    []*CASItem `json:"items"`
+	Metadata Metadata   `json:"metadata,omitempty"`
+}
+
+// CASResponse lists the keys which were swapped.
+type CASResponse struct {
+	Written []string `json:"written"`
+}
+
+// SetNX stores the items whose keys are missing. The response contains one item
+// per written key.
+func (r *rpc) SetNX(in *kvV1.Request, out *kvV1.Response) error {
+	return r.setIf(context.Background(), in, out, true)
+}
+
+// SetXX stores the items whose keys already exist. The response contains one
+// item per written key.
+func (r *rpc) SetXX(in *kvV1.Request, out *kvV1.Response) error {
+	return r.setIf(context.Background(), in, out, false)
+}
+
+func (r *rpc) setIf(ctx context.Context, in *kvV1.Request, out *kvV1.Response, missing bool) error {
+	name := "setxx"
+	if missing {
+		name = "setnx"
+	}
+	op := errors.Op("rpc_" + name)
+
+	in, md, err := requestMetadata(in)
+	ctx, span := r.tracer.Start(requestContext(ctx, md), "kv:"+name)
+	defer span.End()
+
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	ctx, cancel, err := withClientTimeout(ctx, md)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.GetStorage())
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+	st := entry.Storage
+	entry.traceKeys(span, keysOf(in.GetItems()))
+
+	items, err := entry.itemsFrom(in.GetItems())
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	start := time.Now()
+	written, err := bounded(ctx, entry, opWrite, func(ctx context.Context) ([]string, error) {
+		return r.conditionalSet(ctx, in.GetStorage(), st, items, missing)
+	})
+	r.metrics.observe(in.GetStorage(), name, start, len(in.GetItems()), err)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	out.Items = make([]*kvV1.Item, 0, len(written))
+	for _, k := range written {
+		out.Items = append(out.Items, &kvV1.Item{Key: k})
+	}
+	return nil
+}
+
+// conditionalSet writes the items whose keys are missing (or exist, when missing
+// is false) through the ConditionalWriter capability or the gateway fallback.
+func (r *rpc) conditionalSet(ctx context.Context, storage string, st kv.Storage, items []kv.Item, missing bool) ([]string, error) {
+	switch cw, ok := st.(ConditionalWriter); {
+	case ok && missing:
+		return cw.SetNX(ctx, items...)
+	case ok:
+		return cw.SetXX(ctx, items...)
+	default:
+		return r.setIfFallback(ctx, storage, st, items, missing)
+	}
+}
+
+// setIfFallback emulates SetNX and SetXX with Has and Set under the striped lock.
+// When a key is repeated, SetNX writes its first item and SetXX its last one.
+func (r *rpc) setIfFallback(ctx context.Context, storage string, st kv.Storage, items []kv.Item, missing bool) ([]string, error) {
+	keys := make([]string, 0, len(items))
+	for _, it := range items {
+		keys = append(keys, it.Key())
+	}
+
+	unlock, err := r.pl.stripes.lock(ctx, storage, keys...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	exists, err := st.Has(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{}, len(items))
+	toSet := make([]kv.Item, 0, len(items))
+	written := make([]string, 0, len(items))
+	for _, it := range items {
+		_, dup := seen[it.Key()]
+		if exists[it.Key()] == missing || (dup && missing) {
+			continue
+		}
+
+		toSet = append(toSet, it)
+		if !dup {
+			seen[it.Key()] = struct{}{}
+			written = append(written, it.Key())
+		}
+	}
+
+	if len(toSet) == 0 {
+		return written, nil
+	}
+
+	if err := st.Set(ctx, toSet...); err != nil {
+		return nil, err
+	}
+
+	return written, nil
+}
+
+// CompareAndSwap stores every item whose key currently holds the expected value.
+func (r *rpc) CompareAndSwap(in *CASRequest, out *CASResponse) error {
+	const op = errors.Op("rpc_compare_and_swap")
+
+	ctx, span := r.tracer.Start(contextFrom(in.Metadata), "kv:compare_and_swap")
+	defer span.End()
+
+	ctx, cancel, err := withClientTimeout(ctx, in.Metadata)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.Storage)
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+	st := entry.Storage
+
+	keys := make([]string, 0, len(in.Items))
+	for _, it := range in.Items {
+		keys = append(keys, it.Key)
+	}
+	entry.traceKeys(span, keys)
+
+	// the timeouts are checked before any storage call
+	now := time.Now()
+	items := make([]*CASItem, 0, len(in.Items))
+	for _, it := range in.Items {
+		timeout, err := entry.timeoutFrom(it.Timeout, now)
+		if err != nil {
+			err = fmt.Errorf("%w, key: %s", err, it.Key)
+			entry.recordError(span, err)
+			return rpcError(op, err)
+		}
+		items = append(items, &CASItem{Key: it.Key, Value: it.Value, Timeout: timeout, Expected: it.Expected})
+	}
+
+	start := time.Now()
+	written, err := bounded(ctx, entry, opWrite, func(ctx context.Context) ([]string, error) {
+		return r.compareAndSwap(ctx, in.Storage, st, items)
+	})
+	r.metrics.observe(in.Storage, "compare_and_swap", start, len(in.Items), err)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	out.Written = written
+	return nil
+}
+
+// compareAndSwap swaps the items through the ConditionalWriter capability or the
+// gateway fallback and returns the written keys.
+func (r *rpc) compareAndSwap(ctx context.Context, storage string, st kv.Storage, items []*CASItem) ([]string, error) {
+	cw, ok := st.(ConditionalWriter)
+	if !ok {
+		return r.casFallback(ctx, storage, st, items)
+	}
+
+	written := make([]string, 0, len(items))
+	for _, it := range items {
+		swapped, err := cw.CompareAndSwap(ctx, &Item{key: it.Key, val: it.Value, timeout: it.Timeout}, it.Expected)
+		if err != nil {
+			return nil, err
+		}
+
+		if swapped {
+			written = append(written, it.Key)
+		}
+	}
+
+	return written, nil
+}
+
+// casFallback emulates CompareAndSwap with MGet and Set under the striped lock.
+// Items are applied in order, so a repeated key is compared against the value
+// written by the previous item.
+func (r *rpc) casFallback(ctx context.Context, storage string, st kv.Storage, items []*CASItem) ([]string, error) {
+	keys := make([]string, 0, len(items))
+	for _, it := range items {
+		keys = append(keys, it.Key)
+	}
+
+	unlock, err := r.pl.stripes.lock(ctx, storage, keys...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	current, err := st.MGet(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	toSet := make([]kv.Item, 0, len(items))
+	written := make([]string, 0, len(items))
+	for _, it := range items {
+		val, ok := current[it.Key]
+		if !ok || val == nil || !bytes.Equal(val, it.Expected) {
+			continue
+		}
+
+		// a nil value would read as missing for the next item of the same key
+		current[it.Key] = append([]byte{}, it.Value...)
+		toSet = append(toSet, &Item{key: it.Key, val: it.Value, timeout: it.Timeout})
+		written = append(written, it.Key)
+	}
+
+	if len(toSet) == 0 {
+		return written, nil
+	}
+
+	if err := st.Set(ctx, toSet...); err != nil {
+		return nil, err
+	}
+
+	return written, nil
+}
@@ -0,0 +1,138 @@
+package kv
+
+import (
+	"context"
+	"testing"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// conditionalStorage is a memStorage with the native ConditionalWriter
+// capability. It writes nothing and answers with the canned results.
+type conditionalStorage struct {
+	*memStorage
+
+	nxItems, xxItems []itemSnapshot
+	casExpected      [][]byte
+}
+
+func (c *conditionalStorage) SetNX(_ context.Context, items ...kv.Item) ([]string, error) {
+	c.nxItems = snapshot(items)
+
+	return []string{firstKey}, nil
+}
+
+func (c *conditionalStorage) SetXX(_ context.Context, items ...kv.Item) ([]string, error) {
+	c.xxItems = snapshot(items)
+
+	return []string{secondKey}, nil
+}
+
+func (c *conditionalStorage) CompareAndSwap(_ context.Context, item kv.Item, expected []byte) (bool, error) {
+	c.casExpected = append(c.casExpected, expected)
+
+	return item.Key() == firstKey, nil
+}
+
+func TestRPCConditionalNative(t *testing.T) {
+	st := &conditionalStorage{memStorage: newMemStorage()}
+	r, rec := newRPC(t, st)
+
+	var out kvV1.Response
+	require.NoError(t, r.SetNX(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &out))
+	assert.Equal(t, []string{firstKey}, responseKeys(&out))
+	assert.Len(t, st.nxItems, 2)
+
+	require.NoError(t, r.SetXX(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &out))
+	assert.Equal(t, []string{secondKey}, responseKeys(&out))
+	assert.Len(t, st.xxItems, 2)
+
+	var cas CASResponse
+	require.NoError(t, r.CompareAndSwap(&CASRequest{Storage: servedStorage, Items: []*CASItem{
+		{Key: firstKey, Value: []byte("new"), Expected: []byte("old")},
+		{Key: secondKey, Value: []byte("new"), Expected: []byte("other")},
+	}}, &cas))
+	assert.Equal(t, []string{firstKey}, cas.Written)
+	assert.Equal(t, [][]byte{[]byte("old"), []byte("other")}, st.casExpected)
+
+	// the native capability is trusted, the fallback didn't write anything
+	_, ok := st.item(firstKey)
+	assert.False(t, ok)
+
+	ended := rec.Ended()
+	require.Len(t, ended, 3)
+	assert.Equal(t, "kv:setnx", ended[0].Name())
+	assert.Equal(t, "kv:setxx", ended[1].Name())
+	assert.Equal(t, "kv:compare_and_swap", ended[2].Name())
+}
+
+func TestRPCSetNXFallback(t *testing.T) {
+	st := newMemStorage()
+	st.put(firstKey, "old", "")
+	r, _ := newRPC(t, st)
+
+	items := append(twoItems(), &kvV1.Item{Key: secondKey, Value: []byte("late")})
+
+	var out kvV1.Response
+	require.NoError(t, r.SetNX(&kvV1.Request{Storage: servedStorage, Items: items}, &out))
+	assert.Equal(t, []string{secondKey}, responseKeys(&out))
+
+	it, _ := st.item(firstKey)
+	assert.Equal(t, "old", string(it.value))
+	// the first writer of a repeated key wins
+	it, _ = st.item(secondKey)
+	assert.Equal(t, "b", string(it.value))
+}
+
+func TestRPCSetXXFallback(t *testing.T) {
+	st := newMemStorage()
+	st.put(firstKey, "old", "")
+	r, _ := newRPC(t, st)
+
+	var out kvV1.Response
+	require.NoError(t, r.SetXX(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &out))
+	assert.Equal(t, []string{firstKey}, responseKeys(&out))
+
+	it, _ := st.item(firstKey)
+	assert.Equal(t, itemSnapshot{key: firstKey, value: []byte("a"), timeout: rfc3339Expiry}, it)
+	_, ok := st.item(secondKey)
+	assert.False(t, ok)
+}
+
+func TestRPCCompareAndSwapFallback(t *testing.T) {
+	st := newMemStorage()
+	st.put(firstKey, "v1", "")
+	st.put(secondKey, "v1", "")
+	r, _ := newRPC(t, st)
+
+	var out CASResponse
+	require.NoError(t, r.CompareAndSwap(&CASRequest{Storage: servedStorage, Items: []*CASItem{
+		{Key: firstKey, Value: []byte("v2"), Expected: []byte("v1"), Timeout: rfc3339Expiry},
+		// compared against the value written by the previous item
+		{Key: firstKey, Value: []byte("v3"), Expected: []byte("v2")},
+		{Key: secondKey, Value: []byte("v2"), Expected: []byte("stale")},
+		{Key: "gamma", Value: []byte("v2")},
+	}}, &out))
+	assert.Equal(t, []string{firstKey, firstKey}, out.Written)
+
+	it, _ := st.item(firstKey)
+	assert.Equal(t, "v3", string(it.value))
+	it, _ = st.item(secondKey)
+	assert.Equal(t, "v1", string(it.value))
+	_, ok := st.item("gamma")
+	assert.False(t, ok)
+}
+
+func TestRPCConditionalLookup(t *testing.T) {
+	r, _ := newRPC(t, newMemStorage())
+
+	var out kvV1.Response
+	require.ErrorIs(t, r.SetNX(&kvV1.Request{Items: twoItems()}, &out), errEmptyStorage)
+	require.ErrorIs(t, r.SetXX(&kvV1.Request{Storage: "ghost", Items: twoItems()}, &out), errNoSuchStore)
+
+	var cas CASResponse
+	require.ErrorIs(t, r.CompareAndSwap(&CASRequest{Storage: "ghost"}, &cas), errNoSuchStore)
+}
@@ -0,0 +1,160 @@
+package kv
+
+import (
+	"context"
+	stderr "errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/roadrunner-server/errors"
+)
+
+var (
+	errNotInteger      = stderr.New("value is not an integer")
+	errCounterOverflow = stderr.New("increment or decrement would overflow")
+)
+
+// Counter is an optional capability of the kv.Storage. Drivers implementing it
+// update integer values atomically on the backend side.
+type Counter interface {
+	// Increment adds delta (negative to decrement) to the integer stored under the
+	// key and returns the new value. A missing key is created with initial+delta
+	// and the timeout (RFC 3339, empty for no expiry), an existing key keeps its
+	// expiry.
+	Increment(ctx context.Context, key string, delta, initial int64, timeout string) (int64, error)
+}
+
+// CounterRequest is the payload of the kv.Increment and kv.Decrement RPC calls.
+type CounterRequest struct {
+	Storage string `json:"storage"`
+	Key     string `json:"key"`
+	// Delta is the step of the operation, 1 when omitted
+	Delta *int64 `json:"delta,omitempty"`
+	// Initial is the value the missing key starts from
+	Initial int64 `json:"initial,omitempty"`
+	// Timeout is applied only when the key is created
+	Timeout  string   `json:"timeout,omitempty"`
+	Metadata Metadata `json:"metadata,omitempty"`
+}
+
+// CounterResponse holds the value of the counter after the operation.
+type CounterResponse struct {
+	Value int64 `json:"value"`
+}
+
+// Increment adds the delta to the counter stored under the key.
+func (r *rpc) Increment(in *CounterRequest, out *CounterResponse) error {
+	return r.count(in, out, false)
+}
+
+// Decrement subtracts the delta from the counter stored under the key.
+func (r *rpc) Decrement(in *CounterRequest, out *CounterResponse) error {
+	return r.count(in, out, true)
+}
+
+func (r *rpc) count(in *CounterRequest, out *CounterResponse, decrement bool) error {
+	name := "increment"
+	if decrement {
+		name = "decrement"
+	}
+	op := errors.Op("rpc_" + name)
+
+	ctx, span := r.tracer.Start(contextFrom(in.Metadata), "kv:"+name)
+	defer span.End()
+
+	ctx, cancel, err := withClientTimeout(ctx, in.Metadata)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.Storage)
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+	st := entry.Storage
+	entry.traceKeys(span, []string{in.Key})
+
+	delta := int64(1)
+	if in.Delta != nil {
+		delta = *in.Delta
+	}
+
+	if decrement {
+		if delta == math.MinInt64 {
+			entry.recordError(span, errCounterOverflow)
+			return rpcError(op, errCounterOverflow)
+		}
+		delta = -delta
+	}
+
+	timeout, err := entry.timeoutFrom(in.Timeout, time.Now())
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	start := time.Now()
+	val, err := bounded(ctx, entry, opWrite, func(ctx context.Context) (int64, error) {
+		if c, ok := st.(Counter); ok {
+			return c.Increment(ctx, in.Key, delta, in.Initial, timeout)
+		}
+		return r.incrementFallback(ctx, in.Storage, st, in.Key, delta, in.Initial, timeout)
+	})
+	r.metrics.observe(in.Storage, name, start, 1, err)
+
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	out.Value = val
+	return nil
+}
+
+// incrementFallback emulates Counter with Get and Set under the striped lock. The
+// expiry of an existing key is preserved when the driver reports it via TTL, the
+// drivers without TTL support (memcached) get the requested timeout instead.
+func (r *rpc) incrementFallback(ctx context.Context, storage string, st kv.Storage, key string, delta, initial int64, timeout string) (int64, error) {
+	unlock, err := r.pl.stripes.lock(ctx, storage, key)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	data, err := st.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	cur := initial
+	if data != nil {
+		cur, err = strconv.ParseInt(string(data), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s", errNotInteger, key)
+		}
+
+		ttl, errT := st.TTL(ctx, key)
+		if errT == nil {
+			timeout = ttl[key]
+		}
+	}
+
+	if (delta > 0 && cur > math.MaxInt64-delta) || (delta < 0 && cur < math.MinInt64-delta) {
+		return 0, fmt.Errorf("%w: %s", errCounterOverflow, key)
+	}
+	cur += delta
+
+	err = st.Set(ctx, &Item{key: key, val: []byte(strconv.FormatInt(cur, 10)), timeout: timeout})
+	if err != nil {
+		return 0, err
+	}
+
+	return cur, nil
+}
@@ -0,0 +1,125 @@
+package kv
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// counterStorage is a memStorage with the native Counter capability. It only
+// records the arguments it was called with.
+type counterStorage struct {
+	*memStorage
+
+	key            string
+	delta, initial int64
+	timeout        string
+}
+
+func (c *counterStorage) Increment(_ context.Context, key string, delta, initial int64, timeout string) (int64, error) {
+	c.key, c.delta, c.initial, c.timeout = key, delta, initial, timeout
+
+	return 42, nil
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestRPCCounterNative(t *testing.T) {
+	st := &counterStorage{memStorage: newMemStorage()}
+	r, rec := newRPC(t, st)
+
+	var out CounterResponse
+	require.NoError(t, r.Decrement(&CounterRequest{
+		Storage: servedStorage,
+		Key:     firstKey,
+		Delta:   ptr[int64](5),
+		Initial: 10,
+		Timeout: rfc3339Expiry,
+	}, &out))
+
+	assert.Equal(t, int64(42), out.Value)
+	assert.Equal(t, firstKey, st.key)
+	assert.Equal(t, int64(-5), st.delta)
+	assert.Equal(t, int64(10), st.initial)
+	assert.Equal(t, rfc3339Expiry, st.timeout)
+
+	// the fallback is not used, so nothing was written through Set
+	_, ok := st.item(firstKey)
+	assert.False(t, ok)
+
+	ended := rec.Ended()
+	require.Len(t, ended, 1)
+	assert.Equal(t, "kv:decrement", ended[0].Name())
+}
+
+func TestRPCCounterFallback(t *testing.T) {
+	st := newMemStorage()
+	r, _ := newRPC(t, st)
+
+	var out CounterResponse
+	require.NoError(t, r.Increment(&CounterRequest{Storage: servedStorage, Key: firstKey, Initial: 10, Timeout: rfc3339Expiry}, &out))
+	assert.Equal(t, int64(11), out.Value)
+
+	it, ok := st.item(firstKey)
+	require.True(t, ok)
+	assert.Equal(t, "11", string(it.value))
+	assert.Equal(t, rfc3339Expiry, it.timeout)
+
+	// the existing key keeps its expiry and ignores the initial value and timeout
+	require.NoError(t, r.Decrement(&CounterRequest{Storage: servedStorage, Key: firstKey, Delta: ptr[int64](20), Initial: 100}, &out))
+	assert.Equal(t, int64(-9), out.Value)
+
+	it, _ = st.item(firstKey)
+	assert.Equal(t, "-9", string(it.value))
+	assert.Equal(t, rfc3339Expiry, it.timeout)
+}
+
+func TestRPCCounterFallbackIsSerialized(t *testing.T) {
+	st := newMemStorage()
+	r, _ := newRPC(t, st)
+
+	const workers, rounds = 8, 50
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for range rounds {
+				var out CounterResponse
+				assert.NoError(t, r.Increment(&CounterRequest{Storage: servedStorage, Key: firstKey}, &out))
+			}
+		})
+	}
+	wg.Wait()
+
+	it, _ := st.item(firstKey)
+	assert.Equal(t, strconv.Itoa(workers*rounds), string(it.value))
+}
+
+func TestRPCCounterErrors(t *testing.T) {
+	st := newMemStorage()
+	st.put(firstKey, "not a number", "")
+	st.put(secondKey, strconv.FormatInt(math.MaxInt64, 10), "")
+	r, _ := newRPC(t, st)
+
+	var out CounterResponse
+	require.ErrorIs(t, r.Increment(&CounterRequest{Key: firstKey}, &out), errEmptyStorage)
+
+	err := r.Increment(&CounterRequest{Storage: servedStorage, Key: firstKey}, &out)
+	assert.ErrorContains(t, err, errNotInteger.Error())
+	assert.ErrorContains(t, err, "rpc_increment")
+
+	err = r.Increment(&CounterRequest{Storage: servedStorage, Key: secondKey}, &out)
+	assert.ErrorContains(t, err, errCounterOverflow.Error())
+
+	err = r.Decrement(&CounterRequest{Storage: servedStorage, Key: secondKey, Delta: ptr[int64](math.MinInt64)}, &out)
+	assert.ErrorContains(t, err, errCounterOverflow.Error())
+	assert.ErrorContains(t, err, "rpc_decrement")
+
+	it, _ := st.item(secondKey)
+	assert.Equal(t, strconv.FormatInt(math.MaxInt64, 10), string(it.value))
+}
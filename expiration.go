@@ -0,0 +1,162 @@
+package kv
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+)
+
+// maxRelativeSeconds is the largest integer timeout read as a number of seconds,
+// 30 days. Larger integers are Unix timestamps, the same as in memcached.
+const maxRelativeSeconds = 30 * 24 * 60 * 60
+
+// normalizeTimeout converts the item timeout to the RFC 3339 time the drivers
+// expect. Accepted are:
+//   - a Go duration, relative to now, for example 30s or 1h30m;
+//   - an integer: seconds relative to now, up to 30 days, a Unix timestamp above;
+//   - an RFC 3339 time.
+//
+// An empty timeout means no expiration and is returned as is. Malformed and past
+// timeouts are rejected with ErrInvalidTTL.
+func normalizeTimeout(timeout string, now time.Time) (string, error) {
+	at, err := parseTimeout(timeout, now)
+	if err != nil {
+		return "", err
+	}
+
+	return formatTimeout(at), nil
+}
+
+// parseTimeout returns the expiration time of the item timeout, the zero time
+// when the timeout is empty.
+func parseTimeout(timeout string, now time.Time) (time.Time, error) {
+	if timeout == "" {
+		return time.Time{}, nil
+	}
+
+	var at time.Time
+	if n, err := strconv.ParseInt(timeout, 10, 64); err == nil {
+		switch {
+		case n <= 0:
+			return time.Time{}, fmt.Errorf("%w: %q should be positive", ErrInvalidTTL, timeout)
+		case n <= maxRelativeSeconds:
+			at = now.Add(time.Duration(n) * time.Second)
+		default:
+			at = time.Unix(n, 0)
+		}
+	} else if d, err := time.ParseDuration(timeout); err == nil {
+		at = now.Add(d)
+	} else if at, err = time.Parse(time.RFC3339, timeout); err != nil {
+		return time.Time{}, fmt.Errorf("%w: %q should be a duration, seconds, a Unix timestamp or an RFC 3339 time", ErrInvalidTTL, timeout)
+	}
+
+	if !at.After(now) {
+		return time.Time{}, fmt.Errorf("%w: %q is in the past", ErrInvalidTTL, timeout)
+	}
+
+	return at, nil
+}
+
+// parseTTL returns the relative TTL: a Go duration or an integer number of
+// seconds, up to 30 days. The absolute timeouts, Unix timestamps and RFC 3339
+// times, are rejected with ErrInvalidArgument, malformed TTLs with ErrInvalidTTL.
+func parseTTL(ttl string) (time.Duration, error) {
+	var d time.Duration
+	if n, err := strconv.ParseInt(ttl, 10, 64); err == nil {
+		if n > maxRelativeSeconds {
+			return 0, fmt.Errorf("%w: the ttl %q is a Unix timestamp, should be relative", ErrInvalidArgument, ttl)
+		}
+		d = time.Duration(n) * time.Second
+	} else if d, err = time.ParseDuration(ttl); err != nil {
+		if _, err := time.Parse(time.RFC3339, ttl); err == nil {
+			return 0, fmt.Errorf("%w: the ttl %q is an RFC 3339 time, should be relative", ErrInvalidArgument, ttl)
+		}
+		return 0, fmt.Errorf("%w: %q should be a duration or seconds", ErrInvalidTTL, ttl)
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("%w: %q should be positive", ErrInvalidTTL, ttl)
+	}
+
+	return d, nil
+}
+
+// formatTimeout returns the RFC 3339 timeout of the expiration time, an empty
+// one for the zero time.
+func formatTimeout(at time.Time) string {
+	if at.IsZero() {
+		return ""
+	}
+
+	return at.UTC().Format(time.RFC3339Nano)
+}
+
+// applyTTL applies the TTL policy of the storage to the expiration time, the
+// zero time meaning no expiration. The items without a timeout get the default
+// TTL, or the maximum one, the jitter randomizes the TTL and the maximum caps it.
+func (o *storageOptions) applyTTL(at, now time.Time) time.Time {
+	var ttl time.Duration
+	switch {
+	case !at.IsZero():
+		ttl = at.Sub(now)
+	case o.defaultTTL > 0:
+		ttl = o.defaultTTL
+	case o.maxTTL > 0:
+		ttl = o.maxTTL
+	default:
+		return at
+	}
+
+	if o.ttlJitter > 0 {
+		ttl += time.Duration(float64(ttl) * o.ttlJitter / 100 * (2*rand.Float64() - 1))
+	}
+
+	if o.maxTTL > 0 && ttl > o.maxTTL {
+		ttl = o.maxTTL
+	}
+
+	return now.Add(ttl)
+}
+
+// itemsFrom converts the request items to the driver items, with the timeouts
+// normalized and the TTL policy of the storage applied.
+func (e *storageEntry) itemsFrom(tr []*kvV1.Item) ([]kv.Item, error) {
+	now := time.Now()
+	items := make([]kv.Item, 0, len(tr))
+	for i := range tr {
+		it, err := e.itemFrom(tr[i], now)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, nil
+}
+
+func (e *storageEntry) itemFrom(it *kvV1.Item, now time.Time) (*Item, error) {
+	timeout, err := e.timeoutFrom(it.GetTimeout(), now)
+	if err != nil {
+		return nil, fmt.Errorf("%w, key: %s", err, it.GetKey())
+	}
+
+	return &Item{
+		key:     it.GetKey(),
+		val:     it.GetValue(),
+		timeout: timeout,
+	}, nil
+}
+
+// timeoutFrom normalizes the timeout of a write and applies the TTL policy of the
+// storage to it, see normalizeTimeout and storageOptions.applyTTL.
+func (e *storageEntry) timeoutFrom(timeout string, now time.Time) (string, error) {
+	at, err := parseTimeout(timeout, now)
+	if err != nil {
+		return "", err
+	}
+
+	return formatTimeout(e.opts.applyTTL(at, now)), nil
+}
@@ -0,0 +1,200 @@
+package kv
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeTimeout(t *testing.T) {
+	now := time.Date(2030, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name    string
+		timeout string
+		want    string
+	}{
+		{name: "no timeout", timeout: "", want: ""},
+		{name: "duration", timeout: "30s", want: "2030-05-01T12:00:30Z"},
+		{name: "compound duration", timeout: "1h30m", want: "2030-05-01T13:30:00Z"},
+		{name: "sub-second duration", timeout: "250ms", want: "2030-05-01T12:00:00.25Z"},
+		{name: "seconds", timeout: "90", want: "2030-05-01T12:01:30Z"},
+		{name: "30 days in seconds", timeout: strconv.Itoa(maxRelativeSeconds), want: "2030-05-31T12:00:00Z"},
+		{name: "unix timestamp", timeout: strconv.FormatInt(now.Add(time.Hour).Unix(), 10), want: "2030-05-01T13:00:00Z"},
+		{name: "rfc3339", timeout: "2030-05-02T00:00:00Z", want: "2030-05-02T00:00:00Z"},
+		{name: "rfc3339 with offset", timeout: "2030-05-01T15:00:00+02:00", want: "2030-05-01T13:00:00Z"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := normalizeTimeout(tc.timeout, now)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestNormalizeTimeoutErrors(t *testing.T) {
+	now := time.Date(2030, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name    string
+		timeout string
+		err     string
+	}{
+		{name: "malformed", timeout: "tomorrow", err: "should be a duration, seconds, a Unix timestamp or an RFC 3339 time"},
+		{name: "zero seconds", timeout: "0", err: "should be positive"},
+		{name: "negative seconds", timeout: "-5", err: "should be positive"},
+		{name: "negative duration", timeout: "-1m", err: "is in the past"},
+		{name: "past unix timestamp", timeout: strconv.FormatInt(now.Add(-time.Hour).Unix(), 10), err: "is in the past"},
+		{name: "past rfc3339", timeout: "2030-05-01T11:59:59Z", err: "is in the past"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := normalizeTimeout(tc.timeout, now)
+			assert.ErrorIs(t, err, ErrInvalidTTL)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestRPCSetNormalizesTimeouts(t *testing.T) {
+	st := newMemStorage()
+	r, _ := newRPC(t, st)
+
+	require.NoError(t, r.Set(&kvV1.Request{Storage: servedStorage, Items: []*kvV1.Item{
+		{Key: firstKey, Value: []byte("a"), Timeout: "1h"},
+		{Key: secondKey, Value: []byte("b")},
+	}}, &kvV1.Response{}))
+
+	it, ok := st.item(firstKey)
+	require.True(t, ok)
+	at, err := time.Parse(time.RFC3339, it.timeout)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), at, time.Minute)
+
+	it, _ = st.item(secondKey)
+	assert.Empty(t, it.timeout)
+}
+
+func TestRPCRejectsPastTimeoutBeforeDriverCall(t *testing.T) {
+	st := &fakeStorage{}
+	r, _ := newRPC(t, st)
+
+	items := []*kvV1.Item{
+		{Key: firstKey, Value: []byte("a"), Timeout: "1h"},
+		{Key: secondKey, Value: []byte("b"), Timeout: "2001-01-01T00:00:00Z"},
+	}
+
+	err := r.Set(&kvV1.Request{Storage: servedStorage, Items: items}, &kvV1.Response{})
+	assert.ErrorContains(t, err, `[invalid_ttl] rpc_set: invalid ttl: "2001-01-01T00:00:00Z" is in the past, key: beta`)
+
+	err = r.SetNX(&kvV1.Request{Storage: servedStorage, Items: items}, &kvV1.Response{})
+	assert.ErrorContains(t, err, "[invalid_ttl]")
+
+	err = r.CompareAndSwap(&CASRequest{Storage: servedStorage, Items: []*CASItem{{Key: firstKey, Timeout: "soon"}}}, &CASResponse{})
+	assert.ErrorContains(t, err, "[invalid_ttl]")
+
+	err = r.Increment(&CounterRequest{Storage: servedStorage, Key: firstKey, Timeout: "0"}, &CounterResponse{})
+	assert.ErrorContains(t, err, "[invalid_ttl]")
+
+	assert.Empty(t, st.recorded().setItems)
+	assert.Empty(t, st.recorded().hasKeys)
+}
+
+func TestApplyTTL(t *testing.T) {
+	now := time.Date(2030, 5, 1, 12, 0, 0, 0, time.UTC)
+	inHour := now.Add(time.Hour)
+	inWeek := now.Add(7 * 24 * time.Hour)
+
+	cases := []struct {
+		name string
+		opts storageOptions
+		at   time.Time
+		want time.Time
+	}{
+		{name: "no policy, no expiration", at: time.Time{}, want: time.Time{}},
+		{name: "no policy keeps the timeout", at: inWeek, want: inWeek},
+		{name: "default for no expiration", opts: storageOptions{defaultTTL: time.Hour}, at: time.Time{}, want: inHour},
+		{name: "default keeps the timeout", opts: storageOptions{defaultTTL: time.Hour}, at: inWeek, want: inWeek},
+		{name: "max caps the timeout", opts: storageOptions{maxTTL: time.Hour}, at: inWeek, want: inHour},
+		{name: "max for no expiration", opts: storageOptions{maxTTL: time.Hour}, at: time.Time{}, want: inHour},
+		{name: "max keeps a shorter timeout", opts: storageOptions{maxTTL: 24 * time.Hour}, at: inHour, want: inHour},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.opts.applyTTL(tc.at, now))
+		})
+	}
+}
+
+func TestApplyTTLJitter(t *testing.T) {
+	now := time.Date(2030, 5, 1, 12, 0, 0, 0, time.UTC)
+	opts := storageOptions{ttlJitter: 10, maxTTL: 105 * time.Minute}
+
+	distinct := make(map[time.Time]struct{})
+	for range 100 {
+		at := opts.applyTTL(now.Add(100*time.Minute), now)
+		distinct[at] = struct{}{}
+
+		// 100m +/- 10%, capped by the maximum
+		assert.False(t, at.Before(now.Add(90*time.Minute)), at)
+		assert.False(t, at.After(now.Add(105*time.Minute)), at)
+	}
+	assert.Greater(t, len(distinct), 1)
+}
+
+func TestRPCSetAppliesTTLPolicy(t *testing.T) {
+	st := newMemStorage()
+	r, _ := newRPCWithSection(t, st, map[string]any{"driver": "fake", "default_ttl": "1h", "max_ttl": "2h"})
+
+	require.NoError(t, r.Set(&kvV1.Request{Storage: servedStorage, Items: []*kvV1.Item{
+		{Key: firstKey, Value: []byte("a")},
+		{Key: secondKey, Value: []byte("b"), Timeout: "8760h"},
+	}}, &kvV1.Response{}))
+
+	expiresIn := func(key string) time.Duration {
+		it, ok := st.item(key)
+		require.True(t, ok)
+		at, err := time.Parse(time.RFC3339, it.timeout)
+		require.NoError(t, err)
+		return time.Until(at)
+	}
+	assert.InDelta(t, time.Hour.Seconds(), expiresIn(firstKey).Seconds(), 60)
+	assert.InDelta(t, (2 * time.Hour).Seconds(), expiresIn(secondKey).Seconds(), 60)
+
+	// the default satisfies the timeout mexpire requires
+	var out ItemsResponse
+	require.NoError(t, r.MExpireDetailed(&ItemsRequest{Storage: servedStorage, Items: []*kvV1.Item{{Key: firstKey}}}, &out))
+	assert.True(t, out.Results[0].Applied)
+}
+
+func TestRPCAtomicWritesApplyTTLPolicy(t *testing.T) {
+	st := &counterStorage{memStorage: newMemStorage()}
+	st.put(firstKey, "v1", "")
+	r, _ := newRPCWithSection(t, st, map[string]any{"driver": "fake", "max_ttl": "2h"})
+
+	var cas CASResponse
+	require.NoError(t, r.CompareAndSwap(&CASRequest{Storage: servedStorage, Items: []*CASItem{
+		{Key: firstKey, Value: []byte("v2"), Expected: []byte("v1"), Timeout: "8760h"},
+	}}, &cas))
+	require.Equal(t, []string{firstKey}, cas.Written)
+
+	it, ok := st.item(firstKey)
+	require.True(t, ok)
+	at, err := time.Parse(time.RFC3339, it.timeout)
+	require.NoError(t, err)
+	assert.InDelta(t, (2 * time.Hour).Seconds(), time.Until(at).Seconds(), 60)
+
+	// the counter without a timeout gets max_ttl, it can't bypass the cap
+	require.NoError(t, r.Increment(&CounterRequest{Storage: servedStorage, Key: secondKey}, &CounterResponse{}))
+	at, err = time.Parse(time.RFC3339, st.timeout)
+	require.NoError(t, err)
+	assert.InDelta(t, (2 * time.Hour).Seconds(), time.Until(at).Seconds(), 60)
+}
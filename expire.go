@@ -0,0 +1,206 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/roadrunner-server/errors"
+)
+
+// Expirer is an optional capability of the kv.Storage. Drivers implementing it
+// change the expiration of the keys without rewriting their values.
+type Expirer interface {
+	// Persist removes the expiration of the keys and returns the existing ones.
+	Persist(ctx context.Context, keys ...string) ([]string, error)
+	// Touch sets the expiration of the keys to the timeout, an RFC 3339 time, and
+	// returns the existing ones.
+	Touch(ctx context.Context, timeout string, keys ...string) ([]string, error)
+}
+
+// TouchRequest is the payload of the kv.Touch RPC call.
+type TouchRequest struct {
+	Storage string   `json:"storage"`
+	Keys    []string `json:"keys"`
+	// TTL is the new lifetime of the keys, counted from now, for example 30s or 30.
+	// The absolute times are rejected.
+	TTL      string   `json:"ttl"`
+	Metadata Metadata `json:"metadata,omitempty"`
+}
+
+// ExpiryResponse lists the existing keys whose expiration was changed.
+type ExpiryResponse struct {
+	Keys []string `json:"keys"`
+}
+
+// Persist removes the expiration of the keys, so they live until deleted. The
+// drivers without the Expirer capability get the values rewritten without a
+// timeout, see persistFallback.
+func (r *rpc) Persist(in *KeysRequest, out *ExpiryResponse) error {
+	const op = errors.Op("rpc_persist")
+
+	ctx, span := r.tracer.Start(contextFrom(in.Metadata), "kv:persist")
+	defer span.End()
+
+	ctx, cancel, err := withClientTimeout(ctx, in.Metadata)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.Storage)
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+	st := entry.Storage
+	entry.traceKeys(span, in.Keys)
+
+	// the keys without expiration would bypass the cap
+	if entry.opts.maxTTL > 0 {
+		err = fmt.Errorf("%w: the TTL of the %s storage is capped by %s", ErrInvalidTTL, in.Storage, maxTTL)
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	start := time.Now()
+	keys, err := bounded(ctx, entry, opWrite, func(ctx context.Context) ([]string, error) {
+		if ex, ok := st.(Expirer); ok {
+			return ex.Persist(ctx, in.Keys...)
+		}
+		return r.persistFallback(ctx, in.Storage, st, in.Keys)
+	})
+	r.metrics.observe(in.Storage, "persist", start, len(in.Keys), err)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	out.Keys = keys
+	return nil
+}
+
+// Touch sets the expiration of the keys to the TTL counted from now.
+func (r *rpc) Touch(in *TouchRequest, out *ExpiryResponse) error {
+	const op = errors.Op("rpc_touch")
+
+	ctx, span := r.tracer.Start(contextFrom(in.Metadata), "kv:touch")
+	defer span.End()
+
+	ctx, cancel, err := withClientTimeout(ctx, in.Metadata)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.Storage)
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+	st := entry.Storage
+	entry.traceKeys(span, in.Keys)
+
+	ttl, err := parseTTL(in.TTL)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+	now := time.Now()
+	timeout := formatTimeout(entry.opts.applyTTL(now.Add(ttl), now))
+
+	start := time.Now()
+	keys, err := bounded(ctx, entry, opWrite, func(ctx context.Context) ([]string, error) {
+		if ex, ok := st.(Expirer); ok {
+			return ex.Touch(ctx, timeout, in.Keys...)
+		}
+		return touchFallback(ctx, st, timeout, in.Keys)
+	})
+	r.metrics.observe(in.Storage, "touch", start, len(in.Keys), err)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	out.Keys = keys
+	return nil
+}
+
+// touchFallback emulates the Expirer.Touch with Has and MExpire. The values are
+// left as is, so a write racing with it is not rolled back.
+func touchFallback(ctx context.Context, st kv.Storage, timeout string, keys []string) ([]string, error) {
+	exists, err := st.Has(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{}, len(keys))
+	items := make([]kv.Item, 0, len(keys))
+	touched := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if _, dup := seen[k]; dup || !exists[k] {
+			continue
+		}
+
+		seen[k] = struct{}{}
+		items = append(items, &Item{key: k, timeout: timeout})
+		touched = append(touched, k)
+	}
+
+	if len(items) == 0 {
+		return touched, nil
+	}
+
+	if err := st.MExpire(ctx, items...); err != nil {
+		return nil, err
+	}
+
+	return touched, nil
+}
+
+// persistFallback emulates the Expirer.Persist with MGet and Set under the
+// striped lock: the values of the existing keys are rewritten without a timeout.
+// The plain set and delete calls don't take the stripes, so a write or a delete
+// of a key landing between the MGet and the Set is lost: the written value is
+// rolled back, the deleted key comes back.
+func (r *rpc) persistFallback(ctx context.Context, storage string, st kv.Storage, keys []string) ([]string, error) {
+	unlock, err := r.pl.stripes.lock(ctx, storage, keys...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	current, err := st.MGet(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{}, len(keys))
+	items := make([]kv.Item, 0, len(keys))
+	persisted := make([]string, 0, len(keys))
+	for _, k := range keys {
+		val, ok := current[k]
+		if _, dup := seen[k]; dup || !ok || val == nil {
+			continue
+		}
+
+		seen[k] = struct{}{}
+		items = append(items, &Item{key: k, val: val})
+		persisted = append(persisted, k)
+	}
+
+	if len(items) == 0 {
+		return persisted, nil
+	}
+
+	if err := st.Set(ctx, items...); err != nil {
+		return nil, err
+	}
+
+	return persisted, nil
+}
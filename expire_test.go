@@ -0,0 +1,127 @@
+package kv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expirerStorage implements the Expirer capability natively.
+type expirerStorage struct {
+	*memStorage
+	persisted []string
+	touched   string
+}
+
+func (e *expirerStorage) Persist(_ context.Context, keys ...string) ([]string, error) {
+	e.persisted = keys
+	return keys[:1], nil
+}
+
+func (e *expirerStorage) Touch(_ context.Context, timeout string, keys ...string) ([]string, error) {
+	e.touched = timeout
+	return keys, nil
+}
+
+func TestRPCPersistFallback(t *testing.T) {
+	st := newMemStorage()
+	st.put(firstKey, "a", rfc3339Expiry)
+	r, _ := newRPC(t, st)
+
+	var out ExpiryResponse
+	require.NoError(t, r.Persist(&KeysRequest{Storage: servedStorage, Keys: []string{firstKey, secondKey, firstKey}}, &out))
+
+	// the missing key is not created, the repeated one is rewritten once
+	assert.Equal(t, []string{firstKey}, out.Keys)
+
+	it, _ := st.item(firstKey)
+	assert.Empty(t, it.timeout)
+	assert.Equal(t, []byte("a"), it.value)
+
+	_, ok := st.item(secondKey)
+	assert.False(t, ok)
+}
+
+func TestRPCTouchFallback(t *testing.T) {
+	st := newMemStorage()
+	st.put(firstKey, "a", "")
+	st.put(secondKey, "b", rfc3339Expiry)
+	r, _ := newRPC(t, st)
+
+	var out ExpiryResponse
+	require.NoError(t, r.Touch(&TouchRequest{Storage: servedStorage, Keys: []string{firstKey, secondKey}, TTL: "30s"}, &out))
+	assert.Equal(t, []string{firstKey, secondKey}, out.Keys)
+
+	for _, k := range out.Keys {
+		it, _ := st.item(k)
+		at, err := time.Parse(time.RFC3339, it.timeout)
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(30*time.Second), at, 5*time.Second)
+	}
+}
+
+func TestRPCTouchFallbackKeepsValues(t *testing.T) {
+	st := &fakeStorage{hasRet: map[string]bool{firstKey: true}}
+	r, _ := newRPC(t, st)
+
+	var out ExpiryResponse
+	require.NoError(t, r.Touch(&TouchRequest{Storage: servedStorage, Keys: []string{firstKey, secondKey, firstKey}, TTL: "30s"}, &out))
+	assert.Equal(t, []string{firstKey}, out.Keys)
+
+	// only the expiration of the existing key changes, the values are not rewritten
+	calls := st.recorded()
+	assert.Empty(t, calls.setItems)
+	require.Len(t, calls.expireItems, 1)
+	assert.Equal(t, firstKey, calls.expireItems[0].key)
+	assert.NotEmpty(t, calls.expireItems[0].timeout)
+}
+
+func TestRPCExpirerCapability(t *testing.T) {
+	st := &expirerStorage{memStorage: newMemStorage()}
+	r, _ := newRPCWithSection(t, st, map[string]any{"driver": "fake", "max_ttl": "1m"})
+
+	var out ExpiryResponse
+	require.NoError(t, r.Touch(&TouchRequest{Storage: servedStorage, Keys: []string{firstKey}, TTL: "1h"}, &out))
+	assert.Equal(t, []string{firstKey}, out.Keys)
+
+	// the TTL policy caps the touched keys too
+	at, err := time.Parse(time.RFC3339, st.touched)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), at, 5*time.Second)
+
+	// the keys without expiration would bypass max_ttl
+	err = r.Persist(&KeysRequest{Storage: servedStorage, Keys: []string{firstKey}}, &out)
+	assert.ErrorContains(t, err, "[invalid_ttl] rpc_persist")
+	assert.Nil(t, st.persisted)
+}
+
+func TestRPCExpirerPersistCapability(t *testing.T) {
+	st := &expirerStorage{memStorage: newMemStorage()}
+	r, _ := newRPC(t, st)
+
+	var out ExpiryResponse
+	require.NoError(t, r.Persist(&KeysRequest{Storage: servedStorage, Keys: []string{firstKey, secondKey}}, &out))
+	assert.Equal(t, []string{firstKey, secondKey}, st.persisted)
+	assert.Equal(t, []string{firstKey}, out.Keys)
+}
+
+func TestRPCTouchErrors(t *testing.T) {
+	r, _ := newRPC(t, newMemStorage())
+
+	for _, ttl := range []string{"", "later", "-1s"} {
+		err := r.Touch(&TouchRequest{Storage: servedStorage, Keys: []string{firstKey}, TTL: ttl}, &ExpiryResponse{})
+		assert.ErrorContains(t, err, "[invalid_ttl] rpc_touch", ttl)
+	}
+
+	// the absolute timeouts the items accept are not TTLs
+	for _, ttl := range []string{rfc3339Expiry, "2082758400"} {
+		err := r.Touch(&TouchRequest{Storage: servedStorage, Keys: []string{firstKey}, TTL: ttl}, &ExpiryResponse{})
+		assert.ErrorContains(t, err, "[invalid_argument] rpc_touch", ttl)
+	}
+
+	err := r.Persist(&KeysRequest{Storage: "ghost", Keys: []string{firstKey}}, &ExpiryResponse{})
+	assert.ErrorContains(t, err, "[storage_not_found]")
+}
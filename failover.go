@@ -0,0 +1,310 @@
+package kv
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/roadrunner-server/errors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// failoverDriver is the driver name of the primary/fallback composite
+	failoverDriver string = "failover"
+
+	// keys of the failover section
+	failoverPrimary  string = "primary"
+	failoverFallback string = "fallback"
+	failoverBreaker  string = "breaker"
+	// keys of the breaker section
+	breakerFailures    string = "failures"
+	breakerOpenTimeout string = "open_timeout"
+	breakerProbes      string = "probes"
+
+	// the breaker defaults
+	defaultBreakerFailures    int = 5
+	defaultBreakerOpenTimeout     = 30 * time.Second
+	defaultBreakerProbes      int = 1
+
+	// the storages a failover call is routed to
+	routePrimary  string = "primary"
+	routeFallback string = "fallback"
+)
+
+// failoverSpec is the section of a failover storage:
+//
+//	kv:
+//	  remote:
+//	    driver: redis
+//	    config:
+//	      addrs: ["127.0.0.1:6379"]
+//	  local:
+//	    driver: memory
+//	    config: {}
+//	  cache:
+//	    driver: failover
+//	    primary: remote
+//	    fallback: local
+//	    breaker:
+//	      failures: 5
+//	      open_timeout: 30s
+//	      probes: 1
+type failoverSpec struct {
+	primary, fallback string
+	failures          int
+	openTimeout       time.Duration
+	probes            int
+}
+
+func parseFailover(name string, section map[string]any) (compositeSpec, error) {
+	spec := &failoverSpec{
+		failures:    defaultBreakerFailures,
+		openTimeout: defaultBreakerOpenTimeout,
+		probes:      defaultBreakerProbes,
+	}
+
+	for key, dst := range map[string]*string{
+		failoverPrimary:  &spec.primary,
+		failoverFallback: &spec.fallback,
+	} {
+		str, _ := section[key].(string)
+		if str == "" {
+			return nil, errors.Errorf("the %s storage should reference its %s by the storage name", name, key)
+		}
+		*dst = str
+	}
+
+	if spec.primary == spec.fallback {
+		return nil, errors.Errorf("the primary and fallback of the %s storage should be different storages, got: %s", name, spec.primary)
+	}
+
+	v, ok := section[failoverBreaker]
+	if !ok || v == nil {
+		return spec, nil
+	}
+
+	b, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.Errorf("the %s section of the %s storage should be a map, got: %T", failoverBreaker, name, v)
+	}
+
+	for key, dst := range map[string]*int{
+		breakerFailures: &spec.failures,
+		breakerProbes:   &spec.probes,
+	} {
+		if v, ok := b[key]; ok {
+			*dst = positiveInt(v)
+			if *dst <= 0 {
+				return nil, errors.Errorf("wrong %s.%s value in the %s storage: %v, should be a positive integer", failoverBreaker, key, name, v)
+			}
+		}
+	}
+
+	if v, ok := b[breakerOpenTimeout]; ok {
+		str, _ := v.(string)
+		d, err := time.ParseDuration(str)
+		if err != nil || d <= 0 {
+			return nil, errors.Errorf("wrong %s.%s value in the %s storage: %v, should be a positive duration, for example 30s", failoverBreaker, breakerOpenTimeout, name, v)
+		}
+		spec.openTimeout = d
+	}
+
+	return spec, nil
+}
+
+func (s *failoverSpec) refs() []string {
+	return []string{s.primary, s.fallback}
+}
+
+func (s *failoverSpec) build(env *compositeEnv, tiers []kv.Storage) (kv.Storage, error) {
+	f := &failover{
+		name:         env.name,
+		primary:      tiers[0],
+		fallback:     tiers[1],
+		primaryName:  s.primary,
+		fallbackName: s.fallback,
+		log:          env.log,
+	}
+	f.breaker = newBreaker(s.failures, s.openTimeout, s.probes, f.stateChanged)
+
+	return f, nil
+}
+
+// failover routes the calls to the primary while its circuit breaker is closed
+// and to the fallback while it's open. A call the primary fails as unavailable
+// or timed out is repeated with the fallback, so the callers see the fallback
+// answers instead of the outage, while the other primary errors are returned as
+// they are. The fallback is not synchronized with the primary: the values
+// written while the breaker is open stay in the fallback.
+type failover struct {
+	stopNothing
+
+	name                      string
+	primary, fallback         kv.Storage
+	primaryName, fallbackName string
+	breaker                   *breaker
+	log                       *slog.Logger
+}
+
+// route calls fn with the primary, when the breaker allows it, and with the
+// fallback otherwise or when the primary is unreachable. The span of the ctx is
+// annotated with the breaker state and the storage which answered.
+func route[T any](ctx context.Context, f *failover, fn func(st kv.Storage) (T, error)) (T, error) {
+	span := trace.SpanFromContext(ctx)
+
+	// the call the caller gave up on is neither routed nor counted
+	if err := ctx.Err(); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	ok, gen := f.breaker.allow(ctx)
+	if ok {
+		ret, err := fn(f.primary)
+		f.breaker.done(ctx, gen, err)
+		// the other errors are the answer of the primary, and the fallback can't
+		// answer past the deadline either
+		if !tripping(err) || ctx.Err() != nil {
+			span.SetAttributes(attrBreakerState.String(string(f.breaker.snapshot().state)), attrRoute.String(routePrimary))
+			return ret, err
+		}
+
+		f.log.Debug("primary failed, falling back", "primary", f.primaryName, "error", err)
+	}
+
+	span.SetAttributes(attrBreakerState.String(string(f.breaker.snapshot().state)), attrRoute.String(routeFallback))
+	return fn(f.fallback)
+}
+
+func routeErr(ctx context.Context, f *failover, fn func(st kv.Storage) error) error {
+	_, err := route(ctx, f, func(st kv.Storage) (struct{}, error) {
+		return struct{}{}, fn(st)
+	})
+	return err
+}
+
+// stateChanged reports the breaker transitions in the log and the span.
+func (f *failover) stateChanged(ctx context.Context, from, to BreakerState, err error) {
+	trace.SpanFromContext(ctx).AddEvent("kv.breaker.state_changed", trace.WithAttributes(
+		attrBreakerFrom.String(string(from)),
+		attrBreakerState.String(string(to)),
+	))
+
+	switch to {
+	case BreakerOpen:
+		f.log.Warn("circuit breaker opened, routing to the fallback", "primary", f.primaryName, "fallback", f.fallbackName, "from", from, "error", err)
+	case BreakerHalfOpen:
+		f.log.Info("circuit breaker half-open, probing the primary", "primary", f.primaryName)
+	default:
+		f.log.Info("circuit breaker closed, routing to the primary", "primary", f.primaryName)
+	}
+}
+
+func (f *failover) Has(ctx context.Context, keys ...string) (map[string]bool, error) {
+	return route(ctx, f, func(st kv.Storage) (map[string]bool, error) {
+		return st.Has(ctx, keys...)
+	})
+}
+
+func (f *failover) Get(ctx context.Context, key string) ([]byte, error) {
+	return route(ctx, f, func(st kv.Storage) ([]byte, error) {
+		return st.Get(ctx, key)
+	})
+}
+
+func (f *failover) MGet(ctx context.Context, keys ...string) (map[string][]byte, error) {
+	return route(ctx, f, func(st kv.Storage) (map[string][]byte, error) {
+		return st.MGet(ctx, keys...)
+	})
+}
+
+func (f *failover) TTL(ctx context.Context, keys ...string) (map[string]string, error) {
+	return route(ctx, f, func(st kv.Storage) (map[string]string, error) {
+		return st.TTL(ctx, keys...)
+	})
+}
+
+func (f *failover) Set(ctx context.Context, items ...kv.Item) error {
+	return routeErr(ctx, f, func(st kv.Storage) error {
+		return st.Set(ctx, items...)
+	})
+}
+
+func (f *failover) MExpire(ctx context.Context, items ...kv.Item) error {
+	return routeErr(ctx, f, func(st kv.Storage) error {
+		return st.MExpire(ctx, items...)
+	})
+}
+
+func (f *failover) Delete(ctx context.Context, keys ...string) error {
+	return routeErr(ctx, f, func(st kv.Storage) error {
+		return st.Delete(ctx, keys...)
+	})
+}
+
+func (f *failover) Clear(ctx context.Context) error {
+	return routeErr(ctx, f, func(st kv.Storage) error {
+		return st.Clear(ctx)
+	})
+}
+
+// BreakerStatus is the circuit breaker of a failover storage.
+type BreakerStatus struct {
+	Storage  string       `json:"storage"`
+	Primary  string       `json:"primary"`
+	Fallback string       `json:"fallback"`
+	State    BreakerState `json:"state"`
+	// Failures is the number of the consecutive primary failures in the closed state
+	Failures int `json:"failures"`
+	// OpenedAt is the RFC 3339 time the breaker opened last
+	OpenedAt string `json:"opened_at,omitempty"`
+	// LastError is the last error of the primary
+	LastError string `json:"last_error,omitempty"`
+}
+
+// BreakersResponse is the answer of the kv.Breakers RPC call.
+type BreakersResponse struct {
+	Breakers []*BreakerStatus `json:"breakers"`
+}
+
+func (f *failover) status() *BreakerStatus {
+	snap := f.breaker.snapshot()
+
+	st := &BreakerStatus{
+		Storage:  f.name,
+		Primary:  f.primaryName,
+		Fallback: f.fallbackName,
+		State:    snap.state,
+		Failures: snap.consecutive,
+	}
+	if !snap.openedAt.IsZero() {
+		st.OpenedAt = formatTimeout(snap.openedAt)
+	}
+	if snap.lastErr != nil {
+		st.LastError = snap.lastErr.Error()
+	}
+
+	return st
+}
+
+// Breakers lists the circuit breakers of the failover storages, sorted by the
+// storage name.
+func (r *rpc) Breakers(_ bool, out *BreakersResponse) error {
+	entries := r.pl.storages.snapshot()
+
+	out.Breakers = make([]*BreakerStatus, 0)
+	for _, entry := range entries {
+		if f, ok := entry.Storage.(*failover); ok {
+			out.Breakers = append(out.Breakers, f.status())
+		}
+	}
+	slices.SortFunc(out.Breakers, func(a, b *BreakerStatus) int {
+		return cmp.Compare(a.Storage, b.Storage)
+	})
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package kv
+
+import (
+	"context"
+	stderr "errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/roadrunner-server/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const failoverStorage = "cache"
+
+// newFailoverRPC serves the cache storage, a failover of the primary storage to
+// the fallback one, opening after two failures.
+func newFailoverRPC(t *testing.T, primary *fakeStorage, fallback *memStorage) (*rpc, *tracetest.SpanRecorder, *capHandler) {
+	t.Helper()
+
+	return newCompositeRPC(t, map[string]any{
+		"remote": map[string]any{"driver": "primary"},
+		"local":  map[string]any{"driver": "fallback"},
+		failoverStorage: map[string]any{
+			"driver":   failoverDriver,
+			"primary":  "remote",
+			"fallback": "local",
+			"breaker":  map[string]any{"failures": 2, "open_timeout": "1h"},
+		},
+	}, map[string]kv.Storage{"primary": primary, "fallback": fallback})
+}
+
+func TestFailoverRoutesToFallback(t *testing.T) {
+	primary := &fakeStorage{getRet: map[string][]byte{firstKey: []byte("primary")}}
+	fallback := newMemStorage()
+	fallback.put(firstKey, "fallback", "")
+	r, rec, h := newFailoverRPC(t, primary, fallback)
+
+	get := func() string {
+		var out kvV1.Response
+		require.NoError(t, r.Get(&kvV1.Request{Storage: failoverStorage, Items: []*kvV1.Item{{Key: firstKey}}}, &out))
+		require.Len(t, out.GetItems(), 1)
+		return string(out.GetItems()[0].GetValue())
+	}
+
+	assert.Equal(t, "primary", get())
+
+	// the failed calls are answered by the fallback
+	primary.err = errDown
+	assert.Equal(t, "fallback", get())
+
+	var out BreakersResponse
+	require.NoError(t, r.Breakers(true, &out))
+	require.Len(t, out.Breakers, 1)
+	assert.Equal(t, BreakerClosed, out.Breakers[0].State)
+	assert.Equal(t, 1, out.Breakers[0].Failures)
+
+	// the breaker opens, the primary is not called anymore
+	assert.Equal(t, "fallback", get())
+	calls := len(primary.recorded().getKeys)
+	primary.err = nil
+	assert.Equal(t, "fallback", get())
+	assert.Len(t, primary.recorded().getKeys, calls)
+
+	require.NoError(t, r.Breakers(true, &out))
+	assert.Equal(t, &BreakerStatus{
+		Storage:   failoverStorage,
+		Primary:   "remote",
+		Fallback:  "local",
+		State:     BreakerOpen,
+		Failures:  2,
+		OpenedAt:  out.Breakers[0].OpenedAt,
+		LastError: errDown.Error(),
+	}, out.Breakers[0])
+	assert.NotEmpty(t, out.Breakers[0].OpenedAt)
+
+	assert.True(t, h.hasWarn("circuit breaker opened"))
+
+	ended := rec.Ended()
+	last := spanAttrs(ended[len(ended)-1])
+	assert.Equal(t, string(BreakerOpen), last[attrBreakerState].AsString())
+	assert.Equal(t, routeFallback, last[attrRoute].AsString())
+
+	opened := false
+	for _, span := range ended {
+		for _, ev := range span.Events() {
+			opened = opened || ev.Name == "kv.breaker.state_changed"
+		}
+	}
+	assert.True(t, opened)
+}
+
+func TestFailoverDriverWrappedOutage(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", stderr.New("connection refused"))}
+	primary := &fakeStorage{err: errors.E(errors.Op("redis_get"), refused)}
+	fallback := newMemStorage()
+	fallback.put(firstKey, "fallback", "")
+	r, _, _ := newFailoverRPC(t, primary, fallback)
+
+	for range 2 {
+		var out kvV1.Response
+		require.NoError(t, r.Get(&kvV1.Request{Storage: failoverStorage, Items: []*kvV1.Item{{Key: firstKey}}}, &out))
+		require.Len(t, out.GetItems(), 1)
+		assert.Equal(t, "fallback", string(out.GetItems()[0].GetValue()))
+	}
+
+	var out BreakersResponse
+	require.NoError(t, r.Breakers(true, &out))
+	assert.Equal(t, BreakerOpen, out.Breakers[0].State)
+}
+
+func TestFailoverReturnsPrimaryAnswers(t *testing.T) {
+	primary := &fakeStorage{err: fmt.Errorf("%w: value too large", ErrInvalidArgument)}
+	fallback := newMemStorage()
+	r, _, _ := newFailoverRPC(t, primary, fallback)
+
+	// the errors other than an outage are not replayed and don't open the breaker
+	for range 3 {
+		err := r.Set(&kvV1.Request{Storage: failoverStorage, Items: twoItems()}, &kvV1.Response{})
+		assert.ErrorContains(t, err, "[invalid_argument]")
+	}
+	_, ok := fallback.item(firstKey)
+	assert.False(t, ok)
+
+	var out BreakersResponse
+	require.NoError(t, r.Breakers(true, &out))
+	assert.Equal(t, BreakerClosed, out.Breakers[0].State)
+	assert.Zero(t, out.Breakers[0].Failures)
+
+	// nor does a call the caller already gave up on
+	primary.err = nil
+	entry, err := r.pl.storages.acquire(failoverStorage)
+	require.NoError(t, err)
+	defer entry.release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = entry.Get(ctx, firstKey)
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, primary.recorded().getKeys)
+}
+
+func TestParseFailover(t *testing.T) {
+	cases := []struct {
+		name    string
+		section map[string]any
+		err     string
+	}{
+		{name: "missing fallback", section: map[string]any{"primary": "a"}, err: "should reference its fallback"},
+		{name: "same storages", section: map[string]any{"primary": "a", "fallback": "a"}, err: "should be different storages"},
+		{name: "breaker not a map", section: map[string]any{"primary": "a", "fallback": "b", "breaker": 5}, err: "the breaker section of the cache storage should be a map"},
+		{name: "zero failures", section: map[string]any{"primary": "a", "fallback": "b", "breaker": map[string]any{"failures": 0}}, err: "wrong breaker.failures value"},
+		{name: "zero open timeout", section: map[string]any{"primary": "a", "fallback": "b", "breaker": map[string]any{"open_timeout": "0s"}}, err: "wrong breaker.open_timeout value"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseFailover(failoverStorage, tc.section)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+
+	spec, err := parseFailover(failoverStorage, map[string]any{"primary": "a", "fallback": "b"})
+	require.NoError(t, err)
+	assert.Equal(t, &failoverSpec{primary: "a", fallback: "b", failures: defaultBreakerFailures, openTimeout: defaultBreakerOpenTimeout, probes: defaultBreakerProbes}, spec)
+}
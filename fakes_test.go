@@ -6,9 +6,12 @@ import (
 	"slices"
 	"strings"
 	"sync"
+	"testing"
 
 	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/stretchr/testify/require"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 // mockCfg satisfies Configurer.
@@ -32,6 +35,9 @@ func (c *mockCfg) UnmarshalKey(_ string, out any) error {
 
 func (c *mockCfg) Has(name string) bool { return c.has[name] }
 
+// Reload has nothing to re-read, the tests change the data in place.
+func (c *mockCfg) Reload() error { return nil }
+
 // capHandler is a slog.Handler that records emitted records so tests can assert
 // which warnings the plugin logged.
 type capHandler struct {
@@ -90,6 +96,7 @@ func snapshot(items []kv.Item) []itemSnapshot {
 
 // recordedCalls is what a fakeStorage was asked to do.
 type recordedCalls struct {
+	getKeys     []string
 	hasKeys     []string
 	mgetKeys    []string
 	ttlKeys     []string
@@ -105,6 +112,7 @@ type recordedCalls struct {
 // stopBlock, when set, holds Stop until the channel is closed.
 type fakeStorage struct {
 	hasRet    map[string]bool
+	getRet    map[string][]byte
 	mgetRet   map[string][]byte
 	ttlRet    map[string]string
 	err       error
@@ -135,8 +143,16 @@ func (f *fakeStorage) Has(_ context.Context, keys ...string) (map[string]bool, e
 	return f.hasRet, nil
 }
 
-func (f *fakeStorage) Get(context.Context, string) ([]byte, error) {
-	return nil, f.err
+func (f *fakeStorage) Get(_ context.Context, key string) ([]byte, error) {
+	f.mu.Lock()
+	f.calls.getKeys = append(f.calls.getKeys, key)
+	f.mu.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	return f.getRet[key], nil
 }
 
 func (f *fakeStorage) MGet(_ context.Context, keys ...string) (map[string][]byte, error) {
@@ -235,3 +251,152 @@ func (c *fakeConstructor) KvFromConfig(_ context.Context, key string) (kv.Storag
 
 	return st, nil
 }
+
+// memStorage is a map-backed kv.Storage for the tests exercising the gateway
+// fallbacks. Missing keys are absent from the Has, MGet and TTL answers, and
+// timeouts are stored as they were received.
+type memStorage struct {
+	mu   sync.Mutex
+	data map[string]itemSnapshot
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{data: make(map[string]itemSnapshot)}
+}
+
+// put stores the value directly, bypassing the kv.Storage surface.
+func (m *memStorage) put(key, value, timeout string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = itemSnapshot{key: key, value: []byte(value), timeout: timeout}
+}
+
+// item returns what is stored under the key.
+func (m *memStorage) item(key string) (itemSnapshot, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	it, ok := m.data[key]
+
+	return it, ok
+}
+
+func (m *memStorage) Has(_ context.Context, keys ...string) (map[string]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ret := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if _, ok := m.data[k]; ok {
+			ret[k] = true
+		}
+	}
+
+	return ret, nil
+}
+
+func (m *memStorage) Get(_ context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if it, ok := m.data[key]; ok {
+		return slices.Clone(it.value), nil
+	}
+
+	return nil, nil
+}
+
+func (m *memStorage) MGet(_ context.Context, keys ...string) (map[string][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ret := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		if it, ok := m.data[k]; ok {
+			ret[k] = slices.Clone(it.value)
+		}
+	}
+
+	return ret, nil
+}
+
+func (m *memStorage) Set(_ context.Context, items ...kv.Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, it := range snapshot(items) {
+		m.data[it.key] = it
+	}
+
+	return nil
+}
+
+func (m *memStorage) MExpire(_ context.Context, items ...kv.Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, it := range items {
+		if cur, ok := m.data[it.Key()]; ok {
+			cur.timeout = it.Timeout()
+			m.data[it.Key()] = cur
+		}
+	}
+
+	return nil
+}
+
+func (m *memStorage) TTL(_ context.Context, keys ...string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ret := make(map[string]string, len(keys))
+	for _, k := range keys {
+		if it, ok := m.data[k]; ok {
+			ret[k] = it.timeout
+		}
+	}
+
+	return ret, nil
+}
+
+func (m *memStorage) Clear(context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clear(m.data)
+
+	return nil
+}
+
+func (m *memStorage) Delete(_ context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, k := range keys {
+		delete(m.data, k)
+	}
+
+	return nil
+}
+
+func (m *memStorage) Stop(context.Context) {}
+
+// newCompositeRPC serves the storages of the kv section cfg, the drivers mapping
+// the driver names to the storages they construct. It returns the rpc adapter
+// together with the recorder of its spans and the handler of its logs.
+func newCompositeRPC(t *testing.T, cfg map[string]any, drivers map[string]kv.Storage) (*rpc, *tracetest.SpanRecorder, *capHandler) {
+	t.Helper()
+
+	p, h := newInitedPlugin(t, cfg, nil)
+
+	tracer, rec := newSpanRecorder()
+	collects := p.Collects()
+	collects[1].Callback(tracer)
+	for name, st := range drivers {
+		collects[0].Callback(&fakeConstructor{name: name, storage: st})
+	}
+	require.NoError(t, serveErr(p.Serve()))
+
+	r, ok := p.RPC().(*rpc)
+	require.True(t, ok)
+
+	return r, rec, h
+}
@@ -0,0 +1,137 @@
+package kv
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/roadrunner-server/api-plugins/v6/status"
+)
+
+const (
+	// healthProbeKey is the key every storage is asked about by the health probe
+	healthProbeKey string = "rr:kv:health"
+	// healthProbeTimeout caps the time a single storage may take to answer the probe
+	healthProbeTimeout = time.Second * 5
+)
+
+// StorageHealth is the probe outcome of a single storage.
+type StorageHealth struct {
+	Name    string `json:"name"`
+	Driver  string `json:"driver"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+	// Latency of the probe, in milliseconds
+	Latency int64 `json:"latency_ms"`
+}
+
+// HealthResponse is the answer of the kv.Health RPC call. The plugin is healthy
+// when every storage answered the probe.
+type HealthResponse struct {
+	Healthy  bool             `json:"healthy"`
+	Storages []*StorageHealth `json:"storages"`
+}
+
+// Status reports 200 when every storage answers the probe and 503 otherwise,
+// it's called by the RoadRunner status plugin.
+func (p *Plugin) Status() (*status.Status, error) {
+	return p.statusCode(), nil
+}
+
+// Ready reports whether the plugin is ready to serve the requests, with the same
+// codes as Status.
+func (p *Plugin) Ready() (*status.Status, error) {
+	return p.statusCode(), nil
+}
+
+func (p *Plugin) statusCode() *status.Status {
+	if !p.health(context.Background()).Healthy {
+		return &status.Status{Code: http.StatusServiceUnavailable}
+	}
+
+	return &status.Status{Code: http.StatusOK}
+}
+
+// health probes all storages concurrently with a cheap Has on the sentinel key.
+func (p *Plugin) health(ctx context.Context) *HealthResponse {
+	entries := p.storages.snapshot()
+
+	res := &HealthResponse{
+		Healthy:  true,
+		Storages: make([]*StorageHealth, 0, len(entries)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name := range entries {
+		wg.Go(func() {
+			sh := p.probe(ctx, name)
+
+			mu.Lock()
+			res.Storages = append(res.Storages, sh)
+			res.Healthy = res.Healthy && sh.Healthy
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+
+	slices.SortFunc(res.Storages, func(a, b *StorageHealth) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	return res
+}
+
+func (p *Plugin) probe(ctx context.Context, name string) *StorageHealth {
+	sh := &StorageHealth{Name: name}
+
+	// the storage might have been removed after the snapshot
+	entry, err := p.storages.acquire(name)
+	if err != nil {
+		sh.Error = err.Error()
+		return sh
+	}
+
+	sh.Driver = entry.info.Driver
+
+	ctx, cancel := context.WithTimeout(ctx, healthProbeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	errCh := make(chan error, 1)
+	// a hung driver might ignore the context, so the probe doesn't wait for it,
+	// the storage is held until the call returns though
+	go func() {
+		defer entry.release()
+		_, errH := entry.Has(ctx, healthProbeKey)
+		errCh <- errH
+	}()
+
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	sh.Latency = time.Since(start).Milliseconds()
+	if err != nil {
+		sh.Error = err.Error()
+		p.log.Warn("storage health probe failed", "storage", name, "error", err)
+		return sh
+	}
+
+	sh.Healthy = true
+	return sh
+}
+
+// Health probes every storage and reports the aggregated and per-storage health.
+func (r *rpc) Health(_ bool, out *HealthResponse) error {
+	ctx, span := r.tracer.Start(context.Background(), "kv:health")
+	defer span.End()
+
+	*out = *r.pl.health(ctx)
+	return nil
+}
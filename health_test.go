@@ -0,0 +1,47 @@
+package kv
+
+import (
+	stderr "errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPluginHealth(t *testing.T) {
+	c := &mockCfg{
+		data: map[string]any{"north": map[string]any{"driver": "fake"}},
+		has:  map[string]bool{PluginName: true},
+	}
+	p, ctor := servedFake(t, c)
+
+	st, err := p.Status()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, st.Code)
+	assert.Equal(t, []string{healthProbeKey}, ctor.created[0].recorded().hasKeys)
+
+	p.Collects()[0].Callback(&fakeConstructor{name: "broken", storage: &fakeStorage{err: stderr.New("connection refused")}})
+	r, ok := p.RPC().(*rpc)
+	require.True(t, ok)
+	var info StorageInfo
+	require.NoError(t, r.AddStorage(&AddStorageRequest{Name: "memcached", Driver: "broken"}, &info))
+
+	st, err = p.Ready()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, st.Code)
+
+	var out HealthResponse
+	require.NoError(t, r.Health(true, &out))
+	assert.False(t, out.Healthy)
+	require.Len(t, out.Storages, 2)
+
+	assert.Equal(t, "memcached", out.Storages[0].Name)
+	assert.Equal(t, "broken", out.Storages[0].Driver)
+	assert.False(t, out.Storages[0].Healthy)
+	assert.Equal(t, "connection refused", out.Storages[0].Error)
+
+	assert.Equal(t, "north", out.Storages[1].Name)
+	assert.True(t, out.Storages[1].Healthy)
+	assert.Empty(t, out.Storages[1].Error)
+}
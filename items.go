@@ -0,0 +1,196 @@
+package kv
+
+import (
+	"context"
+	stderr "errors"
+	"fmt"
+	"time"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/roadrunner-server/errors"
+)
+
+var errAborted = stderr.New("not applied, another item of the request was rejected")
+
+// ItemsRequest is the payload of the kv.SetDetailed, kv.MExpireDetailed and
+// kv.DeleteDetailed RPC calls.
+type ItemsRequest struct {
+	Storage string       `json:"storage"`
+	Items   []*kvV1.Item `json:"items"`
+	// BestEffort applies the valid items even when some items are rejected, and
+	// retries the items one by one when the storage fails them as a whole, unless
+	// it's unavailable or timed out. By default, a rejected item aborts the call
+	// before anything is applied, the valid items are reported as aborted.
+	BestEffort bool     `json:"best_effort,omitempty"`
+	Metadata   Metadata `json:"metadata,omitempty"`
+}
+
+// ItemResult is the outcome of a single item.
+type ItemResult struct {
+	Key     string `json:"key"`
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
+	Code    Code   `json:"code,omitempty"`
+}
+
+// ItemsResponse holds one result per requested item, in the request order.
+type ItemsResponse struct {
+	Results []*ItemResult `json:"results"`
+}
+
+// itemTimeout is how the operation treats the item timeouts.
+type itemTimeout int
+
+const (
+	timeoutIgnored itemTimeout = iota
+	timeoutOptional
+	timeoutRequired
+)
+
+func (res *ItemResult) fail(err error) {
+	res.Error = err.Error()
+	res.Code = codeOf(err)
+}
+
+// SetDetailed is Set reporting the outcome of every item.
+func (r *rpc) SetDetailed(in *ItemsRequest, out *ItemsResponse) error {
+	return r.applyItems(in, out, "set", timeoutOptional, func(ctx context.Context, st kv.Storage, items []kv.Item) error {
+		return st.Set(ctx, items...)
+	})
+}
+
+// MExpireDetailed is MExpire reporting the outcome of every item.
+func (r *rpc) MExpireDetailed(in *ItemsRequest, out *ItemsResponse) error {
+	return r.applyItems(in, out, "mexpire", timeoutRequired, func(ctx context.Context, st kv.Storage, items []kv.Item) error {
+		return st.MExpire(ctx, items...)
+	})
+}
+
+// DeleteDetailed is Delete reporting the outcome of every key.
+func (r *rpc) DeleteDetailed(in *ItemsRequest, out *ItemsResponse) error {
+	return r.applyItems(in, out, "delete", timeoutIgnored, func(ctx context.Context, st kv.Storage, items []kv.Item) error {
+		keys := make([]string, 0, len(items))
+		for _, it := range items {
+			keys = append(keys, it.Key())
+		}
+		return st.Delete(ctx, keys...)
+	})
+}
+
+// applyItems checks the items and applies the valid ones with a single storage
+// call. The item failures are reported in the results, the call itself fails
+// only when the request can't be served at all.
+func (r *rpc) applyItems(in *ItemsRequest, out *ItemsResponse, name string, timeout itemTimeout, apply func(ctx context.Context, st kv.Storage, items []kv.Item) error) error {
+	op := errors.Op("rpc_" + name + "_detailed")
+
+	ctx, span := r.tracer.Start(contextFrom(in.Metadata), "kv:"+name+"_detailed")
+	defer span.End()
+
+	ctx, cancel, err := withClientTimeout(ctx, in.Metadata)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.Storage)
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+	entry.traceKeys(span, keysOf(in.Items))
+
+	now := time.Now()
+	out.Results = make([]*ItemResult, 0, len(in.Items))
+	valid := make([]kv.Item, 0, len(in.Items))
+	results := make([]*ItemResult, 0, len(in.Items))
+	rejected := false
+	for _, it := range in.Items {
+		res := &ItemResult{Key: it.GetKey()}
+		out.Results = append(out.Results, res)
+
+		item, err := entry.checkItem(it, timeout, now)
+		if err != nil {
+			res.fail(err)
+			rejected = true
+			continue
+		}
+
+		valid = append(valid, item)
+		results = append(results, res)
+	}
+
+	if rejected && !in.BestEffort {
+		for _, res := range results {
+			res.fail(errAborted)
+		}
+		return nil
+	}
+
+	if len(valid) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	err = boundedErr(ctx, entry, opWrite, func(ctx context.Context) error {
+		return apply(ctx, entry.Storage, valid)
+	})
+	r.metrics.observe(in.Storage, name, start, len(valid), err)
+	if err == nil {
+		for _, res := range results {
+			res.Applied = true
+		}
+		return nil
+	}
+
+	entry.recordError(span, err)
+	// an unreachable storage fails the items one by one just as well
+	if !in.BestEffort || len(valid) == 1 || unreachable(err) {
+		for _, res := range results {
+			res.fail(err)
+		}
+		return nil
+	}
+
+	// the storage failed the items as a whole, find out which ones it accepts
+	for i, it := range valid {
+		start := time.Now()
+		err := boundedErr(ctx, entry, opWrite, func(ctx context.Context) error {
+			return apply(ctx, entry.Storage, []kv.Item{it})
+		})
+		r.metrics.observe(in.Storage, name, start, 1, err)
+		if err != nil {
+			results[i].fail(err)
+			continue
+		}
+		results[i].Applied = true
+	}
+
+	return nil
+}
+
+// checkItem rejects the items the storage would fail on, before calling it, and
+// normalizes the timeout of the accepted ones.
+func (e *storageEntry) checkItem(it *kvV1.Item, timeout itemTimeout, now time.Time) (kv.Item, error) {
+	if it.GetKey() == "" {
+		return nil, fmt.Errorf("%w: empty key", ErrInvalidArgument)
+	}
+
+	if timeout == timeoutIgnored {
+		return &Item{key: it.GetKey()}, nil
+	}
+
+	item, err := e.itemFrom(it, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// the TTL policy of the storage may provide the missing timeout
+	if timeout == timeoutRequired && item.Timeout() == "" {
+		return nil, fmt.Errorf("%w: no timeout, key: %s", ErrInvalidTTL, it.GetKey())
+	}
+
+	return item, nil
+}
@@ -0,0 +1,184 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pickyStorage fails every Set carrying the refused key, as a backend rejecting
+// a too large value would.
+type pickyStorage struct {
+	*memStorage
+	refused string
+}
+
+func (p *pickyStorage) Set(ctx context.Context, items ...kv.Item) error {
+	for _, it := range items {
+		if it.Key() == p.refused {
+			return fmt.Errorf("%w: value too large", ErrInvalidArgument)
+		}
+	}
+
+	return p.memStorage.Set(ctx, items...)
+}
+
+// threeItems is twoItems plus an item the picky storage refuses.
+func threeItems() []*kvV1.Item {
+	return append(twoItems(), &kvV1.Item{Key: "gamma", Value: []byte("c")})
+}
+
+func applied(out *ItemsResponse) map[string]bool {
+	ret := make(map[string]bool, len(out.Results))
+	for _, res := range out.Results {
+		ret[res.Key] = res.Applied
+	}
+
+	return ret
+}
+
+func TestRPCSetDetailed(t *testing.T) {
+	st := newMemStorage()
+	r, _ := newRPC(t, st)
+
+	var out ItemsResponse
+	require.NoError(t, r.SetDetailed(&ItemsRequest{Storage: servedStorage, Items: twoItems()}, &out))
+
+	assert.Equal(t, map[string]bool{firstKey: true, secondKey: true}, applied(&out))
+	_, ok := st.item(secondKey)
+	assert.True(t, ok)
+}
+
+func TestRPCSetDetailedRejectedItem(t *testing.T) {
+	items := append(twoItems(), &kvV1.Item{Key: "gamma", Value: []byte("c"), Timeout: "tomorrow"})
+
+	t.Run("atomic", func(t *testing.T) {
+		st := newMemStorage()
+		r, _ := newRPC(t, st)
+
+		var out ItemsResponse
+		require.NoError(t, r.SetDetailed(&ItemsRequest{Storage: servedStorage, Items: items}, &out))
+
+		require.Len(t, out.Results, 3)
+		assert.Equal(t, map[string]bool{firstKey: false, secondKey: false, "gamma": false}, applied(&out))
+		assert.Equal(t, CodeInvalidTTL, out.Results[2].Code)
+		// the valid items are not attempted
+		for _, res := range out.Results[:2] {
+			assert.Equal(t, CodeAborted, res.Code)
+			assert.Contains(t, res.Error, errAborted.Error())
+		}
+
+		_, ok := st.item(firstKey)
+		assert.False(t, ok)
+	})
+
+	t.Run("best effort", func(t *testing.T) {
+		st := newMemStorage()
+		r, _ := newRPC(t, st)
+
+		var out ItemsResponse
+		require.NoError(t, r.SetDetailed(&ItemsRequest{Storage: servedStorage, Items: items, BestEffort: true}, &out))
+
+		assert.Equal(t, map[string]bool{firstKey: true, secondKey: true, "gamma": false}, applied(&out))
+		assert.Equal(t, CodeInvalidTTL, out.Results[2].Code)
+
+		_, ok := st.item(firstKey)
+		assert.True(t, ok)
+	})
+}
+
+func TestRPCSetDetailedStorageFailure(t *testing.T) {
+	t.Run("atomic", func(t *testing.T) {
+		r, _ := newRPC(t, &pickyStorage{memStorage: newMemStorage(), refused: "gamma"})
+
+		var out ItemsResponse
+		require.NoError(t, r.SetDetailed(&ItemsRequest{Storage: servedStorage, Items: threeItems()}, &out))
+
+		for _, res := range out.Results {
+			assert.False(t, res.Applied)
+			assert.Equal(t, CodeInvalidArgument, res.Code)
+			assert.Contains(t, res.Error, "value too large")
+		}
+	})
+
+	t.Run("best effort", func(t *testing.T) {
+		st := &pickyStorage{memStorage: newMemStorage(), refused: "gamma"}
+		r, _ := newRPC(t, st)
+
+		var out ItemsResponse
+		require.NoError(t, r.SetDetailed(&ItemsRequest{Storage: servedStorage, Items: threeItems(), BestEffort: true}, &out))
+
+		// the items are retried one by one, so only the refused one fails
+		assert.Equal(t, map[string]bool{firstKey: true, secondKey: true, "gamma": false}, applied(&out))
+		assert.Equal(t, CodeInvalidArgument, out.Results[2].Code)
+
+		_, ok := st.item(secondKey)
+		assert.True(t, ok)
+	})
+}
+
+// downStorage fails every Set as an unreachable backend would, counting the calls.
+type downStorage struct {
+	*memStorage
+	calls atomic.Int32
+}
+
+func (d *downStorage) Set(context.Context, ...kv.Item) error {
+	d.calls.Add(1)
+	return fmt.Errorf("%w: connection refused", ErrUnavailable)
+}
+
+func TestRPCSetDetailedUnreachableStorage(t *testing.T) {
+	st := &downStorage{memStorage: newMemStorage()}
+	r, _ := newRPC(t, st)
+
+	var out ItemsResponse
+	require.NoError(t, r.SetDetailed(&ItemsRequest{Storage: servedStorage, Items: threeItems(), BestEffort: true}, &out))
+
+	// the items are not retried one by one
+	assert.Equal(t, int32(1), st.calls.Load())
+	for _, res := range out.Results {
+		assert.False(t, res.Applied)
+		assert.Equal(t, CodeUnavailable, res.Code)
+	}
+}
+
+func TestRPCMExpireAndDeleteDetailed(t *testing.T) {
+	st := newMemStorage()
+	st.put(firstKey, "a", "")
+	st.put(secondKey, "b", "")
+	r, _ := newRPC(t, st)
+
+	var out ItemsResponse
+	require.NoError(t, r.MExpireDetailed(&ItemsRequest{Storage: servedStorage, Items: twoItems(), BestEffort: true}, &out))
+	assert.Equal(t, map[string]bool{firstKey: true, secondKey: false}, applied(&out))
+	assert.Equal(t, CodeInvalidTTL, out.Results[1].Code)
+
+	it, _ := st.item(firstKey)
+	assert.Equal(t, rfc3339Expiry, it.timeout)
+
+	out = ItemsResponse{}
+	require.NoError(t, r.DeleteDetailed(&ItemsRequest{Storage: servedStorage, Items: []*kvV1.Item{{Key: ""}, {Key: secondKey}}}, &out))
+	assert.Equal(t, CodeInvalidArgument, out.Results[0].Code)
+	assert.False(t, out.Results[1].Applied)
+
+	_, ok := st.item(secondKey)
+	assert.True(t, ok)
+}
+
+func TestRPCDetailedErrors(t *testing.T) {
+	r, _ := newRPC(t, newMemStorage())
+
+	var out ItemsResponse
+	err := r.SetDetailed(&ItemsRequest{Storage: "ghost", Items: twoItems()}, &out)
+	assert.ErrorContains(t, err, "[storage_not_found]")
+
+	err = r.DeleteDetailed(&ItemsRequest{Storage: servedStorage, Metadata: Metadata{"timeout": "never"}}, &out)
+	assert.ErrorContains(t, err, "[invalid_argument] rpc_delete_detailed")
+}
@@ -0,0 +1,187 @@
+package kv
+
+import (
+	"context"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// TTLState tells whether the key exists and expires.
+type TTLState string
+
+const (
+	// TTLMissing - there is no such key
+	TTLMissing TTLState = "missing"
+	// TTLPersistent - the key exists and doesn't expire
+	TTLPersistent TTLState = "persistent"
+	// TTLExpiring - the key exists and expires at ExpiresAt
+	TTLExpiring TTLState = "expiring"
+)
+
+// KeysRequest is the payload of the kv.MGetDetailed and kv.TTLDetailed RPC calls.
+type KeysRequest struct {
+	Storage  string   `json:"storage"`
+	Keys     []string `json:"keys"`
+	Metadata Metadata `json:"metadata,omitempty"`
+}
+
+// KeyValue is the value of a requested key. A found key may hold an empty value.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+	Found bool   `json:"found"`
+}
+
+// MGetResponse holds one value per requested key, in the request order.
+type MGetResponse struct {
+	Items []*KeyValue `json:"items"`
+}
+
+// KeyTTL is the expiration of a requested key.
+type KeyTTL struct {
+	Key   string   `json:"key"`
+	State TTLState `json:"state"`
+	// ExpiresAt is the RFC 3339 expiration time of the expiring key
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// TTLResponse holds one expiration per requested key, in the request order.
+type TTLResponse struct {
+	Items []*KeyTTL `json:"items"`
+}
+
+// MGetDetailed is MGet accounting for every requested key: the missing keys are
+// reported with Found unset instead of being omitted.
+func (r *rpc) MGetDetailed(in *KeysRequest, out *MGetResponse) error {
+	const op = errors.Op("rpc_mget_detailed")
+
+	ctx, span := r.tracer.Start(contextFrom(in.Metadata), "kv:mget_detailed")
+	defer span.End()
+
+	ctx, cancel, err := withClientTimeout(ctx, in.Metadata)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.Storage)
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+	entry.traceKeys(span, in.Keys)
+
+	start := time.Now()
+	ret, err := bounded(ctx, entry, opRead, func(ctx context.Context) (map[string][]byte, error) {
+		return entry.MGet(ctx, in.Keys...)
+	})
+	r.metrics.observe(in.Storage, "mget", start, len(in.Keys), err)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	hits, size := 0, 0
+	out.Items = make([]*KeyValue, 0, len(in.Keys))
+	for _, k := range in.Keys {
+		// drivers either omit the missing keys or report them with a nil value
+		val := ret[k]
+		if val == nil {
+			out.Items = append(out.Items, &KeyValue{Key: k})
+			continue
+		}
+
+		hits++
+		size += len(val)
+		out.Items = append(out.Items, &KeyValue{Key: k, Value: val, Found: true})
+		entry.slide(k)
+	}
+
+	r.metrics.observeHits(in.Storage, "mget", hits, len(in.Keys))
+	r.metrics.observeBytes(in.Storage, "mget", size)
+	span.SetAttributes(attrHits.Int(hits), attrBytes.Int(size))
+	return nil
+}
+
+// TTLDetailed is TTL accounting for every requested key, telling the missing
+// keys from the keys without expiration.
+func (r *rpc) TTLDetailed(in *KeysRequest, out *TTLResponse) error {
+	const op = errors.Op("rpc_ttl_detailed")
+
+	ctx, span := r.tracer.Start(contextFrom(in.Metadata), "kv:ttl_detailed")
+	defer span.End()
+
+	ctx, cancel, err := withClientTimeout(ctx, in.Metadata)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.Storage)
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+	entry.traceKeys(span, in.Keys)
+	entry.flushSliding(ctx)
+
+	start := time.Now()
+	states, err := bounded(ctx, entry, opRead, func(ctx context.Context) (map[string]*KeyTTL, error) {
+		return keyTTLs(ctx, entry, in.Keys)
+	})
+	r.metrics.observe(in.Storage, "ttl", start, len(in.Keys), err)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	out.Items = make([]*KeyTTL, 0, len(in.Keys))
+	for _, k := range in.Keys {
+		out.Items = append(out.Items, &KeyTTL{Key: k, State: states[k].State, ExpiresAt: states[k].ExpiresAt})
+	}
+	return nil
+}
+
+// keyTTLs returns the expiration of every key. Drivers report the keys without
+// expiration either with an empty timeout or not at all, the same way as the
+// missing keys, so such keys are checked with Has.
+func keyTTLs(ctx context.Context, entry *storageEntry, keys []string) (map[string]*KeyTTL, error) {
+	ret, err := entry.TTL(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make(map[string]*KeyTTL, len(keys))
+	unknown := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if ret[k] != "" {
+			states[k] = &KeyTTL{Key: k, State: TTLExpiring, ExpiresAt: ret[k]}
+			continue
+		}
+
+		states[k] = &KeyTTL{Key: k, State: TTLMissing}
+		unknown = append(unknown, k)
+	}
+
+	if len(unknown) == 0 {
+		return states, nil
+	}
+
+	exists, err := entry.Has(ctx, unknown...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range unknown {
+		if exists[k] {
+			states[k].State = TTLPersistent
+		}
+	}
+
+	return states, nil
+}
@@ -0,0 +1,75 @@
+package kv
+
+import (
+	"testing"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRPCMGetDetailed(t *testing.T) {
+	// one driver flavour reports the missing keys with nil values
+	st := &fakeStorage{mgetRet: map[string][]byte{firstKey: {}, secondKey: nil}}
+	r, _ := newRPC(t, st)
+
+	var out MGetResponse
+	require.NoError(t, r.MGetDetailed(&KeysRequest{Storage: servedStorage, Keys: []string{firstKey, secondKey, "gamma"}}, &out))
+
+	assert.Equal(t, []*KeyValue{
+		{Key: firstKey, Value: []byte{}, Found: true},
+		{Key: secondKey},
+		{Key: "gamma"},
+	}, out.Items)
+}
+
+func TestRPCMGetKeepsNilValues(t *testing.T) {
+	r, _ := newRPC(t, &fakeStorage{mgetRet: map[string][]byte{firstKey: []byte("a"), secondKey: nil}})
+
+	// MGet answers what the driver returned, only MGetDetailed normalizes it
+	var out kvV1.Response
+	require.NoError(t, r.MGet(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &out))
+	assert.ElementsMatch(t, []*kvV1.Item{{Key: firstKey, Value: []byte("a")}, {Key: secondKey}}, out.Items)
+}
+
+func TestRPCTTLDetailed(t *testing.T) {
+	st := newMemStorage()
+	st.put(firstKey, "a", rfc3339Expiry)
+	st.put(secondKey, "b", "")
+	r, _ := newRPC(t, st)
+
+	var out TTLResponse
+	require.NoError(t, r.TTLDetailed(&KeysRequest{Storage: servedStorage, Keys: []string{firstKey, secondKey, "gamma"}}, &out))
+
+	assert.Equal(t, []*KeyTTL{
+		{Key: firstKey, State: TTLExpiring, ExpiresAt: rfc3339Expiry},
+		{Key: secondKey, State: TTLPersistent},
+		{Key: "gamma", State: TTLMissing},
+	}, out.Items)
+}
+
+func TestRPCTTLDetailedOmittedPersistentKey(t *testing.T) {
+	// another driver flavour omits the keys without expiration
+	st := &fakeStorage{ttlRet: map[string]string{}, hasRet: map[string]bool{firstKey: true}}
+	r, _ := newRPC(t, st)
+
+	var out TTLResponse
+	require.NoError(t, r.TTLDetailed(&KeysRequest{Storage: servedStorage, Keys: []string{firstKey, secondKey}}, &out))
+
+	assert.Equal(t, []*KeyTTL{
+		{Key: firstKey, State: TTLPersistent},
+		{Key: secondKey, State: TTLMissing},
+	}, out.Items)
+	// only the keys without a timeout are checked
+	assert.Equal(t, []string{firstKey, secondKey}, st.recorded().hasKeys)
+}
+
+func TestRPCKeysDetailedErrors(t *testing.T) {
+	r, _ := newRPC(t, &fakeStorage{err: ErrUnavailable})
+
+	err := r.MGetDetailed(&KeysRequest{Storage: servedStorage, Keys: []string{firstKey}}, &MGetResponse{})
+	assert.ErrorContains(t, err, "[unavailable] rpc_mget_detailed")
+
+	err = r.TTLDetailed(&KeysRequest{Storage: "ghost", Keys: []string{firstKey}}, &TTLResponse{})
+	assert.ErrorContains(t, err, "[storage_not_found]")
+}
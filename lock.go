@@ -0,0 +1,295 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	stderr "errors"
+	"fmt"
+	"time"
+
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/roadrunner-server/errors"
+)
+
+const (
+	// lockKeyPrefix separates the lock keys from the application keys of the storage
+	lockKeyPrefix string = "rr:lock:"
+	// lockRetryInterval is the pause between two acquisition attempts while waiting
+	lockRetryInterval = time.Millisecond * 50
+)
+
+var (
+	errEmptyResource = stderr.New("no lock resource provided")
+	errEmptyOwner    = stderr.New("no lock owner provided")
+	errLockTTL       = stderr.New("lock ttl should be a positive duration")
+)
+
+// ConditionalDeleter is an optional capability of the kv.Storage, used to release
+// the locks. Drivers implementing it check the value and delete the key
+// atomically on the backend side.
+type ConditionalDeleter interface {
+	// CompareAndDelete deletes the key only when its current value equals expected.
+	// It reports whether the key was deleted.
+	CompareAndDelete(ctx context.Context, key string, expected []byte) (bool, error)
+}
+
+// LockRequest is the payload of the kv.Lock, kv.Unlock and kv.RefreshLock RPC calls.
+type LockRequest struct {
+	Storage  string `json:"storage"`
+	Resource string `json:"resource"`
+	// Owner is the token of the lock holder. Lock generates one when it's empty,
+	// Unlock and RefreshLock require it.
+	Owner string `json:"owner,omitempty"`
+	// TTL is the lifetime of the lock, a Go duration, for example 30s
+	TTL string `json:"ttl,omitempty"`
+	// Wait is how long Lock retries a busy lock before giving up, 0 - a single attempt
+	Wait     string   `json:"wait,omitempty"`
+	Metadata Metadata `json:"metadata,omitempty"`
+}
+
+// LockResponse reports the outcome of a lock call.
+type LockResponse struct {
+	// Ok is true when the lock was acquired, released or refreshed
+	Ok    bool   `json:"ok"`
+	Owner string `json:"owner"`
+}
+
+// Lock acquires the lock on the resource for the owner, waiting up to the
+// requested time while the lock is held by someone else.
+func (r *rpc) Lock(in *LockRequest, out *LockResponse) error {
+	const op = errors.Op("rpc_lock")
+
+	ctx, span := r.tracer.Start(contextFrom(in.Metadata), "kv:lock")
+	defer span.End()
+
+	ctx, cancel, err := withClientTimeout(ctx, in.Metadata)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.Storage)
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+	st := entry.Storage
+	entry.traceKeys(span, []string{lockKeyPrefix + in.Resource})
+
+	err = checkLockRequest(in, false)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	ttl, err := lockTTL(in)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	var wait time.Duration
+	if in.Wait != "" {
+		wait, err = time.ParseDuration(in.Wait)
+		if err != nil {
+			entry.recordError(span, err)
+			return rpcError(op, err)
+		}
+	}
+
+	owner := in.Owner
+	if owner == "" {
+		owner = rand.Text()
+	}
+
+	start := time.Now()
+	deadline := start.Add(wait)
+	for {
+		item := &Item{key: lockKeyPrefix + in.Resource, val: []byte(owner), timeout: expiry(ttl)}
+
+		written, errL := bounded(ctx, entry, opWrite, func(ctx context.Context) ([]string, error) {
+			return r.conditionalSet(ctx, in.Storage, st, []kv.Item{item}, true)
+		})
+		if errL != nil {
+			r.metrics.observe(in.Storage, "lock", start, 1, errL)
+			entry.recordError(span, errL)
+			return rpcError(op, errL)
+		}
+
+		if len(written) > 0 || !time.Now().Add(lockRetryInterval).Before(deadline) {
+			r.metrics.observe(in.Storage, "lock", start, 1, nil)
+			out.Ok = len(written) > 0
+			out.Owner = owner
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			errL = timeoutError(ctx, entry)
+			r.metrics.observe(in.Storage, "lock", start, 1, errL)
+			entry.recordError(span, errL)
+			return rpcError(op, errL)
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// Unlock releases the lock on the resource, only when it is held by the owner.
+func (r *rpc) Unlock(in *LockRequest, out *LockResponse) error {
+	const op = errors.Op("rpc_unlock")
+
+	ctx, span := r.tracer.Start(contextFrom(in.Metadata), "kv:unlock")
+	defer span.End()
+
+	ctx, cancel, err := withClientTimeout(ctx, in.Metadata)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.Storage)
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+	st := entry.Storage
+	entry.traceKeys(span, []string{lockKeyPrefix + in.Resource})
+
+	if err := checkLockRequest(in, true); err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	key := lockKeyPrefix + in.Resource
+
+	start := time.Now()
+	released, err := bounded(ctx, entry, opWrite, func(ctx context.Context) (bool, error) {
+		if cd, ok := st.(ConditionalDeleter); ok {
+			return cd.CompareAndDelete(ctx, key, []byte(in.Owner))
+		}
+		return r.compareAndDeleteFallback(ctx, in.Storage, st, key, []byte(in.Owner))
+	})
+	r.metrics.observe(in.Storage, "unlock", start, 1, err)
+
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	out.Ok = released
+	out.Owner = in.Owner
+	return nil
+}
+
+// RefreshLock extends the lifetime of the lock held by the owner to the requested TTL.
+func (r *rpc) RefreshLock(in *LockRequest, out *LockResponse) error {
+	const op = errors.Op("rpc_refresh_lock")
+
+	ctx, span := r.tracer.Start(contextFrom(in.Metadata), "kv:refresh_lock")
+	defer span.End()
+
+	ctx, cancel, err := withClientTimeout(ctx, in.Metadata)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.Storage)
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+	st := entry.Storage
+	entry.traceKeys(span, []string{lockKeyPrefix + in.Resource})
+
+	err = checkLockRequest(in, true)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	ttl, err := lockTTL(in)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	start := time.Now()
+	written, err := bounded(ctx, entry, opWrite, func(ctx context.Context) ([]string, error) {
+		return r.compareAndSwap(ctx, in.Storage, st, []*CASItem{{
+			Key:      lockKeyPrefix + in.Resource,
+			Value:    []byte(in.Owner),
+			Timeout:  expiry(ttl),
+			Expected: []byte(in.Owner),
+		}})
+	})
+	r.metrics.observe(in.Storage, "refresh_lock", start, 1, err)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	out.Ok = len(written) > 0
+	out.Owner = in.Owner
+	return nil
+}
+
+// compareAndDeleteFallback emulates ConditionalDeleter with Get and Delete under
+// the striped lock.
+func (r *rpc) compareAndDeleteFallback(ctx context.Context, storage string, st kv.Storage, key string, expected []byte) (bool, error) {
+	unlock, err := r.pl.stripes.lock(ctx, storage, key)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	val, err := st.Get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	if val == nil || !bytes.Equal(val, expected) {
+		return false, nil
+	}
+
+	if err := st.Delete(ctx, key); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// checkLockRequest validates the resource and, for the calls operating on an
+// acquired lock, the owner of the request.
+func checkLockRequest(in *LockRequest, owned bool) error {
+	if in.Resource == "" {
+		return errEmptyResource
+	}
+
+	if owned && in.Owner == "" {
+		return errEmptyOwner
+	}
+
+	return nil
+}
+
+func lockTTL(in *LockRequest) (time.Duration, error) {
+	ttl, err := time.ParseDuration(in.TTL)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("%w: %q", errLockTTL, in.TTL)
+	}
+
+	return ttl, nil
+}
+
+// expiry returns the RFC 3339 timeout the drivers expect for the given lifetime.
+func expiry(ttl time.Duration) string {
+	return time.Now().Add(ttl).UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,114 @@
+package kv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const lockResource = "invoice-7"
+
+// deleterStorage is a memStorage with the native ConditionalDeleter capability.
+type deleterStorage struct {
+	*memStorage
+
+	deleted []string
+}
+
+func (d *deleterStorage) CompareAndDelete(_ context.Context, key string, _ []byte) (bool, error) {
+	d.deleted = append(d.deleted, key)
+
+	return true, nil
+}
+
+func TestRPCLockLifecycle(t *testing.T) {
+	st := newMemStorage()
+	r, _ := newRPC(t, st)
+
+	var first LockResponse
+	require.NoError(t, r.Lock(&LockRequest{Storage: servedStorage, Resource: lockResource, TTL: "1m"}, &first))
+	require.True(t, first.Ok)
+	require.NotEmpty(t, first.Owner)
+
+	it, ok := st.item(lockKeyPrefix + lockResource)
+	require.True(t, ok)
+	assert.Equal(t, first.Owner, string(it.value))
+	exp, err := time.Parse(time.RFC3339, it.timeout)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), exp, time.Second*5)
+
+	var second LockResponse
+	require.NoError(t, r.Lock(&LockRequest{Storage: servedStorage, Resource: lockResource, Owner: "other", TTL: "1m"}, &second))
+	assert.False(t, second.Ok)
+	assert.Equal(t, "other", second.Owner)
+
+	// neither refresh nor release work with a foreign token
+	var out LockResponse
+	require.NoError(t, r.RefreshLock(&LockRequest{Storage: servedStorage, Resource: lockResource, Owner: "other", TTL: "1h"}, &out))
+	assert.False(t, out.Ok)
+	require.NoError(t, r.Unlock(&LockRequest{Storage: servedStorage, Resource: lockResource, Owner: "other"}, &out))
+	assert.False(t, out.Ok)
+
+	require.NoError(t, r.RefreshLock(&LockRequest{Storage: servedStorage, Resource: lockResource, Owner: first.Owner, TTL: "1h"}, &out))
+	assert.True(t, out.Ok)
+	it, _ = st.item(lockKeyPrefix + lockResource)
+	exp, err = time.Parse(time.RFC3339, it.timeout)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), exp, time.Second*5)
+
+	require.NoError(t, r.Unlock(&LockRequest{Storage: servedStorage, Resource: lockResource, Owner: first.Owner}, &out))
+	assert.True(t, out.Ok)
+	_, ok = st.item(lockKeyPrefix + lockResource)
+	assert.False(t, ok)
+}
+
+func TestRPCLockWait(t *testing.T) {
+	st := newMemStorage()
+	r, _ := newRPC(t, st)
+
+	var held LockResponse
+	require.NoError(t, r.Lock(&LockRequest{Storage: servedStorage, Resource: lockResource, TTL: "1m"}, &held))
+	require.True(t, held.Ok)
+
+	go func() {
+		time.Sleep(lockRetryInterval * 2)
+		var out LockResponse
+		assert.NoError(t, r.Unlock(&LockRequest{Storage: servedStorage, Resource: lockResource, Owner: held.Owner}, &out))
+	}()
+
+	var waiter LockResponse
+	require.NoError(t, r.Lock(&LockRequest{Storage: servedStorage, Resource: lockResource, TTL: "1m", Wait: "5s"}, &waiter))
+	assert.True(t, waiter.Ok)
+	assert.NotEqual(t, held.Owner, waiter.Owner)
+
+	start := time.Now()
+	var timedOut LockResponse
+	require.NoError(t, r.Lock(&LockRequest{Storage: servedStorage, Resource: lockResource, TTL: "1m", Wait: "200ms"}, &timedOut))
+	assert.False(t, timedOut.Ok)
+	assert.GreaterOrEqual(t, time.Since(start), lockRetryInterval)
+}
+
+func TestRPCUnlockNative(t *testing.T) {
+	st := &deleterStorage{memStorage: newMemStorage()}
+	r, _ := newRPC(t, st)
+
+	var out LockResponse
+	require.NoError(t, r.Unlock(&LockRequest{Storage: servedStorage, Resource: lockResource, Owner: "me"}, &out))
+	assert.True(t, out.Ok)
+	assert.Equal(t, []string{lockKeyPrefix + lockResource}, st.deleted)
+}
+
+func TestRPCLockValidation(t *testing.T) {
+	r, _ := newRPC(t, newMemStorage())
+
+	var out LockResponse
+	require.ErrorIs(t, r.Lock(&LockRequest{Resource: lockResource, TTL: "1m"}, &out), errEmptyStorage)
+	assert.ErrorContains(t, r.Lock(&LockRequest{Storage: servedStorage, TTL: "1m"}, &out), errEmptyResource.Error())
+	assert.ErrorContains(t, r.Lock(&LockRequest{Storage: servedStorage, Resource: lockResource}, &out), errLockTTL.Error())
+	assert.ErrorContains(t, r.Lock(&LockRequest{Storage: servedStorage, Resource: lockResource, TTL: "-1s"}, &out), errLockTTL.Error())
+	assert.ErrorContains(t, r.Unlock(&LockRequest{Storage: servedStorage, Resource: lockResource}, &out), errEmptyOwner.Error())
+	assert.ErrorContains(t, r.RefreshLock(&LockRequest{Storage: servedStorage, Resource: lockResource, Owner: "me"}, &out), errLockTTL.Error())
+}
@@ -0,0 +1,132 @@
+package kv
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "rr_kv"
+
+	labelStorage   = "storage"
+	labelOperation = "operation"
+	// labels of the mirror collectors
+	labelSecondary = "secondary"
+	labelResult    = "result"
+	labelKind      = "kind"
+)
+
+// metrics holds the prometheus collectors of the kv operations, labeled with the
+// storage name and the operation (has, get, mget, set and so on).
+type metrics struct {
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	items    *prometheus.HistogramVec
+	bytes    *prometheus.HistogramVec
+	hits     *prometheus.CounterVec
+	misses   *prometheus.CounterVec
+
+	mirrorWrites      *prometheus.CounterVec
+	mirrorDivergences *prometheus.CounterVec
+	mirrorRepairs     *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	labels := []string{labelStorage, labelOperation}
+
+	return &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Total number of the operations executed against the storage.",
+		}, labels),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "errors_total",
+			Help:      "Total number of the operations failed with the storage error.",
+		}, labels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Latency of the storage operations.",
+			Buckets:   prometheus.DefBuckets,
+		}, labels),
+		items: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_items",
+			Help:      "Number of the keys or items per operation.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+		}, labels),
+		bytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "value_bytes",
+			Help:      "Total size of the values written or read by an operation.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 10),
+		}, labels),
+		hits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "hits_total",
+			Help:      "Number of the requested keys found by the Get, MGet and Has operations.",
+		}, labels),
+		misses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "misses_total",
+			Help:      "Number of the requested keys missing in the Get, MGet and Has operations.",
+		}, labels),
+		mirrorWrites: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "mirror_writes_total",
+			Help:      "Writes of the mirror storages replicated to their secondaries, by result: ok, failed or dropped.",
+		}, []string{labelStorage, labelSecondary, labelResult}),
+		mirrorDivergences: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "mirror_divergences_total",
+			Help:      "Keys read from the mirror storages whose secondary copy differs, by kind: missing, stale or extra.",
+		}, []string{labelStorage, labelSecondary, labelKind}),
+		mirrorRepairs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "mirror_repairs_total",
+			Help:      "Diverged keys of the mirror storages repaired in their secondaries, by result: ok or failed.",
+		}, []string{labelStorage, labelSecondary, labelResult}),
+	}
+}
+
+// MetricsCollector returns the kv collectors, it's called by the RoadRunner metrics plugin.
+func (p *Plugin) MetricsCollector() []prometheus.Collector {
+	return []prometheus.Collector{
+		p.metrics.requests,
+		p.metrics.errors,
+		p.metrics.duration,
+		p.metrics.items,
+		p.metrics.bytes,
+		p.metrics.hits,
+		p.metrics.misses,
+		p.metrics.mirrorWrites,
+		p.metrics.mirrorDivergences,
+		p.metrics.mirrorRepairs,
+	}
+}
+
+// observe records a completed operation which started at start and carried n keys or items.
+func (m *metrics) observe(storage, operation string, start time.Time, n int, err error) {
+	m.requests.WithLabelValues(storage, operation).Inc()
+	m.duration.WithLabelValues(storage, operation).Observe(time.Since(start).Seconds())
+	m.items.WithLabelValues(storage, operation).Observe(float64(n))
+
+	if err != nil {
+		m.errors.WithLabelValues(storage, operation).Inc()
+	}
+}
+
+// observeBytes records the total size of the values an operation moved.
+func (m *metrics) observeBytes(storage, operation string, n int) {
+	m.bytes.WithLabelValues(storage, operation).Observe(float64(n))
+}
+
+// observeHits records how many of the requested keys were found.
+func (m *metrics) observeHits(storage, operation string, hits, requested int) {
+	m.hits.WithLabelValues(storage, operation).Add(float64(hits))
+	m.misses.WithLabelValues(storage, operation).Add(float64(max(requested-hits, 0)))
+}
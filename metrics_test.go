@@ -0,0 +1,86 @@
+package kv
+
+import (
+	stderr "errors"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gather registers the plugin collectors and returns the counter values and the
+// histogram sums keyed by name{storage,operation}.
+func gather(t *testing.T, p *Plugin) map[string]float64 {
+	t.Helper()
+
+	reg := prometheus.NewRegistry()
+	for _, c := range p.MetricsCollector() {
+		require.NoError(t, reg.Register(c))
+	}
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			labels := make(map[string]string, 2)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+
+			key := fmt.Sprintf("%s{%s,%s}", f.GetName(), labels[labelStorage], labels[labelOperation])
+			if m.GetHistogram() != nil {
+				values[key] = m.GetHistogram().GetSampleSum()
+				continue
+			}
+			values[key] = m.GetCounter().GetValue()
+		}
+	}
+
+	return values
+}
+
+func TestRPCMetrics(t *testing.T) {
+	st := newMemStorage()
+	st.put(firstKey, "abc", "")
+	r, _ := newRPC(t, st)
+
+	var out kvV1.Response
+	require.NoError(t, r.MGet(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &out))
+	require.NoError(t, r.Has(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &out))
+	require.NoError(t, r.Set(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &out))
+
+	values := gather(t, r.pl)
+	assert.Equal(t, 1.0, values["rr_kv_requests_total{south,mget}"])
+	assert.Equal(t, 1.0, values["rr_kv_hits_total{south,mget}"])
+	assert.Equal(t, 1.0, values["rr_kv_misses_total{south,mget}"])
+	assert.Equal(t, 3.0, values["rr_kv_value_bytes{south,mget}"])
+	assert.Equal(t, 2.0, values["rr_kv_request_items{south,mget}"])
+
+	assert.Equal(t, 1.0, values["rr_kv_hits_total{south,has}"])
+	assert.Equal(t, 1.0, values["rr_kv_misses_total{south,has}"])
+
+	assert.Equal(t, 2.0, values["rr_kv_value_bytes{south,set}"])
+	assert.NotContains(t, values, "rr_kv_errors_total{south,set}")
+}
+
+func TestRPCMetricsErrors(t *testing.T) {
+	r, _ := newRPC(t, &fakeStorage{err: stderr.New("driver is unhappy")})
+
+	for _, m := range rpcMethods() {
+		require.Error(t, m.call(r, &kvV1.Request{Storage: servedStorage, Items: twoItems()}, &kvV1.Response{}))
+	}
+	// the failed lookup doesn't reach any storage, so it's not counted
+	require.Error(t, r.Clear(&kvV1.Request{Storage: "ghost"}, &kvV1.Response{}))
+
+	values := gather(t, r.pl)
+	for _, m := range rpcMethods() {
+		assert.Equal(t, 1.0, values[fmt.Sprintf("rr_kv_requests_total{south,%s}", m.name)], m.name)
+		assert.Equal(t, 1.0, values[fmt.Sprintf("rr_kv_errors_total{south,%s}", m.name)], m.name)
+	}
+	assert.NotContains(t, values, "rr_kv_requests_total{ghost,clear}")
+}
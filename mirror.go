@@ -0,0 +1,447 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	stderr "errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/roadrunner-server/errors"
+)
+
+const (
+	// mirrorDriver is the driver name of the primary/secondaries composite
+	mirrorDriver string = "mirror"
+
+	// keys of the mirror section
+	mirrorPrimary     string = "primary"
+	mirrorSecondaries string = "secondaries"
+	mirrorWrites      string = "writes"
+	mirrorReadRepair  string = "read_repair"
+
+	// the ways the writes reach the secondaries
+	mirrorWritesSync  string = "sync"
+	mirrorWritesAsync string = "async"
+
+	// what the reads do with the secondaries
+	readRepairOff    string = "off"
+	readRepairVerify string = "verify"
+	readRepairOn     string = "repair"
+
+	// mirrorQueue is the number of the async writes and read checks waiting for a
+	// secondary, the ones submitted while it's full are dropped
+	mirrorQueue int = 1024
+
+	// the values of the result label of the mirror metrics
+	resultOK      string = "ok"
+	resultFailed  string = "failed"
+	resultDropped string = "dropped"
+
+	// the values of the kind label of the divergences
+	divergenceMissing string = "missing"
+	divergenceStale   string = "stale"
+	divergenceExtra   string = "extra"
+)
+
+// mirrorSpec is the section of a mirror storage:
+//
+//	kv:
+//	  legacy:
+//	    driver: memcached
+//	    config:
+//	      addr: ["127.0.0.1:11211"]
+//	  next:
+//	    driver: redis
+//	    config:
+//	      addrs: ["127.0.0.1:6379"]
+//	  sessions:
+//	    driver: mirror
+//	    primary: legacy
+//	    secondaries: [next]
+//	    writes: async
+//	    read_repair: repair
+type mirrorSpec struct {
+	primary     string
+	secondaries []string
+	// async writes don't wait for the secondaries
+	async bool
+	// readRepair is off, verify or repair
+	readRepair string
+}
+
+func parseMirror(name string, section map[string]any) (compositeSpec, error) {
+	spec := &mirrorSpec{readRepair: readRepairOff}
+
+	spec.primary, _ = section[mirrorPrimary].(string)
+	if spec.primary == "" {
+		return nil, errors.Errorf("the %s storage should reference its %s by the storage name", name, mirrorPrimary)
+	}
+
+	list, _ := section[mirrorSecondaries].([]any)
+	if len(list) == 0 {
+		return nil, errors.Errorf("the %s storage should list its %s by the storage names", name, mirrorSecondaries)
+	}
+
+	for _, v := range list {
+		str, _ := v.(string)
+		if str == "" || str == spec.primary || slices.Contains(spec.secondaries, str) {
+			return nil, errors.Errorf("wrong %s value in the %s storage: %v, should be the names of distinct storages other than the %s", mirrorSecondaries, name, v, mirrorPrimary)
+		}
+		spec.secondaries = append(spec.secondaries, str)
+	}
+
+	if v, ok := section[mirrorWrites]; ok {
+		switch v {
+		case mirrorWritesSync:
+		case mirrorWritesAsync:
+			spec.async = true
+		default:
+			return nil, errors.Errorf("wrong %s value in the %s storage: %v, should be sync or async", mirrorWrites, name, v)
+		}
+	}
+
+	if v, ok := section[mirrorReadRepair]; ok {
+		str, _ := v.(string)
+		switch str {
+		case readRepairOff, readRepairVerify, readRepairOn:
+			spec.readRepair = str
+		default:
+			return nil, errors.Errorf("wrong %s value in the %s storage: %v, should be off, verify or repair", mirrorReadRepair, name, v)
+		}
+	}
+
+	return spec, nil
+}
+
+func (s *mirrorSpec) refs() []string {
+	return append([]string{s.primary}, s.secondaries...)
+}
+
+func (s *mirrorSpec) build(env *compositeEnv, tiers []kv.Storage) (kv.Storage, error) {
+	m := &mirror{
+		name:       env.name,
+		primary:    tiers[0],
+		async:      s.async,
+		readRepair: s.readRepair,
+		log:        env.log,
+		metrics:    env.metrics,
+	}
+
+	for i, st := range tiers[1:] {
+		sec := &secondary{
+			Storage: st,
+			name:    s.secondaries[i],
+			queue:   make(chan func(), mirrorQueue),
+		}
+		m.secondaries = append(m.secondaries, sec)
+
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			for task := range sec.queue {
+				task()
+			}
+		}()
+	}
+
+	return m, nil
+}
+
+// mirror is a primary/secondaries composite, made for migrating between the
+// storages. The writes go to the primary first and then to every secondary, the
+// reads are answered by the primary. A failed primary write is not replicated.
+//
+// Sync writes wait for the secondaries and fail with their errors. Async writes
+// return once the primary is done, each secondary applies them in the background,
+// in order. With read_repair, the values read from the primary are compared with
+// the secondaries in the background, the diverged keys are counted and, in the
+// repair mode, overwritten with the primary values.
+type mirror struct {
+	name        string
+	primary     kv.Storage
+	secondaries []*secondary
+	async       bool
+	readRepair  string
+	log         *slog.Logger
+	metrics     *metrics
+
+	// wg tracks the workers of the secondaries
+	wg sync.WaitGroup
+}
+
+// secondary is a mirrored storage with the queue of its background work.
+type secondary struct {
+	kv.Storage
+	name  string
+	queue chan func()
+}
+
+// Has is answered by the primary.
+func (m *mirror) Has(ctx context.Context, keys ...string) (map[string]bool, error) {
+	return m.primary.Has(ctx, keys...)
+}
+
+// Get is answered by the primary, the value is checked with the secondaries.
+func (m *mirror) Get(ctx context.Context, key string) ([]byte, error) {
+	val, err := m.primary.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	m.check(ctx, []string{key}, map[string][]byte{key: val})
+	return val, nil
+}
+
+// MGet is answered by the primary, the values are checked with the secondaries.
+func (m *mirror) MGet(ctx context.Context, keys ...string) (map[string][]byte, error) {
+	ret, err := m.primary.MGet(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	m.check(ctx, keys, ret)
+	return ret, nil
+}
+
+// TTL is answered by the primary.
+func (m *mirror) TTL(ctx context.Context, keys ...string) (map[string]string, error) {
+	return m.primary.TTL(ctx, keys...)
+}
+
+// Set writes the items to the primary and then to the secondaries.
+func (m *mirror) Set(ctx context.Context, items ...kv.Item) error {
+	if err := m.primary.Set(ctx, items...); err != nil {
+		return err
+	}
+
+	return m.replicate(ctx, func(ctx context.Context, st kv.Storage) error {
+		return st.Set(ctx, items...)
+	})
+}
+
+// MExpire changes the expiration in the primary and then in the secondaries.
+func (m *mirror) MExpire(ctx context.Context, items ...kv.Item) error {
+	if err := m.primary.MExpire(ctx, items...); err != nil {
+		return err
+	}
+
+	return m.replicate(ctx, func(ctx context.Context, st kv.Storage) error {
+		return st.MExpire(ctx, items...)
+	})
+}
+
+// Delete removes the keys from the primary and then from the secondaries.
+func (m *mirror) Delete(ctx context.Context, keys ...string) error {
+	if err := m.primary.Delete(ctx, keys...); err != nil {
+		return err
+	}
+
+	return m.replicate(ctx, func(ctx context.Context, st kv.Storage) error {
+		return st.Delete(ctx, keys...)
+	})
+}
+
+// Clear cleans the primary and then the secondaries.
+func (m *mirror) Clear(ctx context.Context) error {
+	if err := m.primary.Clear(ctx); err != nil {
+		return err
+	}
+
+	return m.replicate(ctx, func(ctx context.Context, st kv.Storage) error {
+		return st.Clear(ctx)
+	})
+}
+
+// Stop waits for the secondaries to apply the queued writes and checks, the
+// mirrored storages themselves are stopped by their own entries.
+func (m *mirror) Stop(ctx context.Context) {
+	for _, sec := range m.secondaries {
+		close(sec.queue)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		m.log.Warn("mirror stopped before the secondaries applied the queued writes", "error", ctx.Err())
+	}
+}
+
+// replicate applies the write to the secondaries. Sync writes run in parallel and
+// return the joined errors of the failed secondaries, async writes are queued.
+func (m *mirror) replicate(ctx context.Context, write func(ctx context.Context, st kv.Storage) error) error {
+	if m.async {
+		// the queued writes outlive the call, but keep its values (trace context)
+		ctx = context.WithoutCancel(ctx)
+		for _, sec := range m.secondaries {
+			m.submit(sec, func() {
+				m.observeWrite(sec, write(ctx, sec))
+			}, true)
+		}
+
+		return nil
+	}
+
+	errs := make([]error, len(m.secondaries))
+	var wg sync.WaitGroup
+	for i, sec := range m.secondaries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := write(ctx, sec)
+			m.observeWrite(sec, err)
+			if err != nil {
+				errs[i] = fmt.Errorf("secondary %s: %w", sec.name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return stderr.Join(errs...)
+}
+
+// submit queues the task for the secondary without blocking the caller. The
+// dropped writes are counted, the dropped read checks are not.
+func (m *mirror) submit(sec *secondary, task func(), write bool) {
+	select {
+	case sec.queue <- task:
+	default:
+		if write {
+			m.log.Warn("mirror queue is full, the write is not replicated", "secondary", sec.name)
+			m.metrics.mirrorWrites.WithLabelValues(m.name, sec.name, resultDropped).Inc()
+		}
+	}
+}
+
+func (m *mirror) observeWrite(sec *secondary, err error) {
+	if err != nil {
+		m.log.Warn("failed to replicate the write", "secondary", sec.name, "error", err)
+		m.metrics.mirrorWrites.WithLabelValues(m.name, sec.name, resultFailed).Inc()
+		return
+	}
+
+	m.metrics.mirrorWrites.WithLabelValues(m.name, sec.name, resultOK).Inc()
+}
+
+// check queues the comparison of the values read from the primary with the
+// secondaries. A write racing with the check may change the primary after it was
+// read, so the divergent keys are confirmed with the primary once the secondary
+// is read, see compare.
+func (m *mirror) check(ctx context.Context, keys []string, read map[string][]byte) {
+	if m.readRepair == readRepairOff {
+		return
+	}
+
+	// the caller owns the map it's answered with, a composite over the mirror
+	// may write into it while the check runs
+	read = maps.Clone(read)
+	ctx = context.WithoutCancel(ctx)
+	for _, sec := range m.secondaries {
+		m.submit(sec, func() {
+			m.compare(ctx, sec, keys, read)
+		}, false)
+	}
+}
+
+// compare counts the keys whose secondary copy differs from the primary values
+// and repairs them in the repair mode. The primary is read again after the
+// secondary: the keys whose primary value doesn't match the one compared were
+// written in between, and the write, not the check, brings the secondary up to
+// date. A write landing between the second read and the repair is still
+// overwritten, the next check of the key repairs it.
+func (m *mirror) compare(ctx context.Context, sec *secondary, keys []string, want map[string][]byte) {
+	have, err := sec.MGet(ctx, keys...)
+	if err != nil {
+		m.log.Warn("failed to read the secondary for the check", "secondary", sec.name, "error", err)
+		return
+	}
+
+	var diverged []string
+	for _, k := range slices.Compact(slices.Sorted(slices.Values(keys))) {
+		if !bytes.Equal(want[k], have[k]) || (want[k] == nil) != (have[k] == nil) {
+			diverged = append(diverged, k)
+		}
+	}
+	if len(diverged) == 0 {
+		return
+	}
+
+	current, err := m.primary.MGet(ctx, diverged...)
+	if err != nil {
+		m.log.Warn("failed to read the primary for the check", "error", err)
+		return
+	}
+
+	var outdated, extra []string
+	for _, k := range diverged {
+		w, h := want[k], have[k]
+		if c := current[k]; !bytes.Equal(w, c) || (w == nil) != (c == nil) {
+			// written since the primary was read
+			continue
+		}
+
+		var kind string
+		switch {
+		case w == nil:
+			kind = divergenceExtra
+			extra = append(extra, k)
+		case h == nil:
+			kind = divergenceMissing
+			outdated = append(outdated, k)
+		default:
+			kind = divergenceStale
+			outdated = append(outdated, k)
+		}
+
+		m.metrics.mirrorDivergences.WithLabelValues(m.name, sec.name, kind).Inc()
+	}
+
+	if m.readRepair != readRepairOn || len(outdated)+len(extra) == 0 {
+		return
+	}
+
+	err = m.repair(ctx, sec, outdated, extra, want)
+	result := resultOK
+	if err != nil {
+		result = resultFailed
+		m.log.Warn("failed to repair the secondary", "secondary", sec.name, "error", err)
+	}
+	m.metrics.mirrorRepairs.WithLabelValues(m.name, sec.name, result).Add(float64(len(outdated) + len(extra)))
+}
+
+// repair overwrites the outdated keys of the secondary with the primary values and
+// removes the extra ones. The values keep the primary expiration, or the secondary
+// one when the primary doesn't report it (memcached).
+func (m *mirror) repair(ctx context.Context, sec *secondary, outdated, extra []string, want map[string][]byte) error {
+	if len(extra) > 0 {
+		if err := sec.Delete(ctx, extra...); err != nil {
+			return err
+		}
+	}
+
+	if len(outdated) == 0 {
+		return nil
+	}
+
+	timeouts, err := m.primary.TTL(ctx, outdated...)
+	if err != nil {
+		timeouts, _ = sec.TTL(ctx, outdated...)
+	}
+
+	items := make([]kv.Item, 0, len(outdated))
+	for _, k := range outdated {
+		items = append(items, &Item{key: k, val: want[k], timeout: timeouts[k]})
+	}
+
+	return sec.Set(ctx, items...)
+}
@@ -0,0 +1,226 @@
+package kv
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const mirrorStorage = "sessions"
+
+// newMirrorRPC serves the sessions storage, a mirror of the primary storage to
+// the secondary one.
+func newMirrorRPC(t *testing.T, section map[string]any, primary, secondary *memStorage) *rpc {
+	t.Helper()
+
+	section["driver"] = mirrorDriver
+	section[mirrorPrimary] = "legacy"
+	section[mirrorSecondaries] = []any{"next"}
+
+	r, _, _ := newCompositeRPC(t, map[string]any{
+		"legacy":      map[string]any{"driver": "primary"},
+		"next":        map[string]any{"driver": "secondary"},
+		mirrorStorage: section,
+	}, map[string]kv.Storage{"primary": primary, "secondary": secondary})
+
+	return r
+}
+
+func TestMirrorSyncWrites(t *testing.T) {
+	primary, secondary := newMemStorage(), newMemStorage()
+	r := newMirrorRPC(t, map[string]any{}, primary, secondary)
+
+	require.NoError(t, r.Set(&kvV1.Request{Storage: mirrorStorage, Items: twoItems()}, &kvV1.Response{}))
+	for _, st := range []*memStorage{primary, secondary} {
+		it, ok := st.item(firstKey)
+		require.True(t, ok)
+		assert.Equal(t, "a", string(it.value))
+	}
+
+	require.NoError(t, r.Delete(&kvV1.Request{Storage: mirrorStorage, Items: []*kvV1.Item{{Key: firstKey}}}, &kvV1.Response{}))
+	_, ok := secondary.item(firstKey)
+	assert.False(t, ok)
+
+	require.NoError(t, r.Clear(&kvV1.Request{Storage: mirrorStorage}, &kvV1.Response{}))
+	_, ok = secondary.item(secondKey)
+	assert.False(t, ok)
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(r.metrics.mirrorWrites.WithLabelValues(mirrorStorage, "next", resultOK)))
+}
+
+func TestMirrorSyncWriteFailure(t *testing.T) {
+	primary := newMemStorage()
+	m := &mirror{
+		name:        mirrorStorage,
+		primary:     primary,
+		secondaries: []*secondary{{Storage: &fakeStorage{err: assert.AnError}, name: "next"}},
+		log:         slog.New(&capHandler{}),
+		metrics:     newMetrics(),
+	}
+
+	err := m.Set(context.Background(), &Item{key: firstKey, val: []byte("a")})
+	require.ErrorIs(t, err, assert.AnError)
+	assert.ErrorContains(t, err, "secondary next")
+
+	// the primary write is kept
+	_, ok := primary.item(firstKey)
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, testutil.ToFloat64(m.metrics.mirrorWrites.WithLabelValues(mirrorStorage, "next", resultFailed)))
+}
+
+func TestMirrorAsyncWrites(t *testing.T) {
+	primary, secondary := newMemStorage(), newMemStorage()
+	r := newMirrorRPC(t, map[string]any{mirrorWrites: mirrorWritesAsync}, primary, secondary)
+
+	require.NoError(t, r.Set(&kvV1.Request{Storage: mirrorStorage, Items: twoItems()}, &kvV1.Response{}))
+	require.NoError(t, r.Delete(&kvV1.Request{Storage: mirrorStorage, Items: []*kvV1.Item{{Key: firstKey}}}, &kvV1.Response{}))
+
+	// the writes reach the secondary in order
+	assert.Eventually(t, func() bool {
+		_, deleted := secondary.item(firstKey)
+		_, set := secondary.item(secondKey)
+		return !deleted && set
+	}, time.Second, 10*time.Millisecond)
+
+	// the reads are answered by the primary
+	primary.put("gamma", "c", "")
+	var out kvV1.Response
+	require.NoError(t, r.Get(&kvV1.Request{Storage: mirrorStorage, Items: []*kvV1.Item{{Key: "gamma"}}}, &out))
+	assert.Len(t, out.GetItems(), 1)
+}
+
+func TestMirrorReadRepair(t *testing.T) {
+	for _, mode := range []string{mirrorWritesSync, mirrorWritesAsync} {
+		t.Run(mode, func(t *testing.T) {
+			primary, secondary := newMemStorage(), newMemStorage()
+			primary.put(firstKey, "a", rfc3339Expiry)
+			primary.put(secondKey, "b", "")
+			secondary.put(secondKey, "old", "")
+			secondary.put("gamma", "c", "")
+			r := newMirrorRPC(t, map[string]any{mirrorWrites: mode, mirrorReadRepair: readRepairOn}, primary, secondary)
+
+			var out kvV1.Response
+			require.NoError(t, r.MGet(&kvV1.Request{Storage: mirrorStorage, Items: []*kvV1.Item{{Key: firstKey}, {Key: secondKey}, {Key: "gamma"}}}, &out))
+			assert.Len(t, out.GetItems(), 2)
+
+			divergences := func(kind string) float64 {
+				return testutil.ToFloat64(r.metrics.mirrorDivergences.WithLabelValues(mirrorStorage, "next", kind))
+			}
+			assert.Eventually(t, func() bool {
+				return testutil.ToFloat64(r.metrics.mirrorRepairs.WithLabelValues(mirrorStorage, "next", resultOK)) == 3
+			}, time.Second, 10*time.Millisecond)
+			assert.Equal(t, 1.0, divergences(divergenceMissing))
+			assert.Equal(t, 1.0, divergences(divergenceStale))
+			assert.Equal(t, 1.0, divergences(divergenceExtra))
+
+			// the secondary holds the primary values with the primary expiration
+			it, ok := secondary.item(firstKey)
+			require.True(t, ok)
+			assert.Equal(t, rfc3339Expiry, it.timeout)
+			it, ok = secondary.item(secondKey)
+			require.True(t, ok)
+			assert.Equal(t, "b", string(it.value))
+			_, ok = secondary.item("gamma")
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestMirrorReadVerify(t *testing.T) {
+	primary, secondary := newMemStorage(), newMemStorage()
+	primary.put(firstKey, "a", "")
+	r := newMirrorRPC(t, map[string]any{mirrorReadRepair: readRepairVerify}, primary, secondary)
+
+	var out kvV1.Response
+	require.NoError(t, r.Get(&kvV1.Request{Storage: mirrorStorage, Items: []*kvV1.Item{{Key: firstKey}}}, &out))
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(r.metrics.mirrorDivergences.WithLabelValues(mirrorStorage, "next", divergenceMissing)) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// verify only counts the divergence
+	_, ok := secondary.item(firstKey)
+	assert.False(t, ok)
+}
+
+func TestTieredOverAsyncMirror(t *testing.T) {
+	primary, secondary, far := newMemStorage(), newMemStorage(), newMemStorage()
+	secondary.put("gamma", "c", "")
+	far.put(firstKey, "a", "")
+	r, _, _ := newCompositeRPC(t, map[string]any{
+		"legacy": map[string]any{"driver": "primary"},
+		"next":   map[string]any{"driver": "secondary"},
+		"remote": map[string]any{"driver": "far"},
+		mirrorStorage: map[string]any{
+			"driver":          mirrorDriver,
+			mirrorPrimary:     "legacy",
+			mirrorSecondaries: []any{"next"},
+			mirrorWrites:      mirrorWritesAsync,
+			mirrorReadRepair:  readRepairVerify,
+		},
+		tieredStorage: map[string]any{"driver": tieredDriver, tieredNear: mirrorStorage, tieredFar: "remote"},
+	}, map[string]kv.Storage{"primary": primary, "secondary": secondary, "far": far})
+
+	// the tiered storage adds the far values to the map the mirror answered with,
+	// while the mirror checks the values it read (run with -race)
+	var out MGetResponse
+	require.NoError(t, r.MGetDetailed(&KeysRequest{Storage: tieredStorage, Keys: []string{firstKey, "gamma"}}, &out))
+	require.Len(t, out.Items, 2)
+	assert.True(t, out.Items[0].Found)
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(r.metrics.mirrorDivergences.WithLabelValues(mirrorStorage, "next", divergenceExtra)) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestParseMirror(t *testing.T) {
+	cases := []struct {
+		name    string
+		section map[string]any
+		err     string
+	}{
+		{name: "missing primary", section: map[string]any{"secondaries": []any{"b"}}, err: "should reference its primary"},
+		{name: "missing secondaries", section: map[string]any{"primary": "a"}, err: "should list its secondaries"},
+		{name: "primary as secondary", section: map[string]any{"primary": "a", "secondaries": []any{"b", "a"}}, err: "wrong secondaries value"},
+		{name: "duplicated secondary", section: map[string]any{"primary": "a", "secondaries": []any{"b", "b"}}, err: "wrong secondaries value"},
+		{name: "unknown writes", section: map[string]any{"primary": "a", "secondaries": []any{"b"}, "writes": "later"}, err: "wrong writes value"},
+		{name: "unknown read repair", section: map[string]any{"primary": "a", "secondaries": []any{"b"}, "read_repair": true}, err: "wrong read_repair value"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseMirror(mirrorStorage, tc.section)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestMirrorRepairSkipsConcurrentWrites(t *testing.T) {
+	primary, secondary := newMemStorage(), newMemStorage()
+	r := newMirrorRPC(t, map[string]any{mirrorReadRepair: readRepairOn}, primary, secondary)
+	m, ok := r.pl.storages.snapshot()[mirrorStorage].Storage.(*mirror)
+	require.True(t, ok)
+
+	// "a" was read from the primary, then a write of "b" landed on both copies
+	// of the first key, and only on the primary for the second one
+	primary.put(firstKey, "b", "")
+	secondary.put(firstKey, "b", "")
+	primary.put(secondKey, "b", "")
+	m.compare(t.Context(), m.secondaries[0], []string{firstKey, secondKey}, map[string][]byte{firstKey: []byte("a"), secondKey: []byte("a")})
+
+	it, ok := secondary.item(firstKey)
+	require.True(t, ok)
+	assert.Equal(t, "b", string(it.value))
+	_, ok = secondary.item(secondKey)
+	assert.False(t, ok)
+	for _, kind := range []string{divergenceMissing, divergenceStale, divergenceExtra} {
+		assert.Zero(t, testutil.ToFloat64(r.metrics.mirrorDivergences.WithLabelValues(mirrorStorage, "next", kind)))
+	}
+}
@@ -0,0 +1,168 @@
+package kv
+
+import (
+	"time"
+
+	"github.com/roadrunner-server/errors"
+)
+
+const (
+	// tracing is the key of the storage section holding the span options
+	tracing string = "tracing"
+	// timeouts is the key of the storage section holding the operation timeouts
+	timeouts string = "timeouts"
+	// keys of the TTL policy applied to the stored items
+	defaultTTL string = "default_ttl"
+	maxTTL     string = "max_ttl"
+	ttlJitter  string = "ttl_jitter"
+	// slidingTTL is the key of the expiry extension applied on reads
+	slidingTTL string = "sliding_ttl"
+
+	// the ways the keys of an operation are attached to its span
+	spanKeysNone   string = "none"
+	spanKeysHashed string = "hashed"
+	spanKeysPlain  string = "plain"
+)
+
+// storageOptions are the kv-level options of a storage, declared in its section
+// next to the driver and config keys:
+//
+//	kv:
+//	  users:
+//	    driver: redis
+//	    tracing:
+//	      keys: hashed
+//	    timeouts:
+//	      read: 500ms
+//	      write: 1s
+//	      clear: 10s
+//	    default_ttl: 1h
+//	    max_ttl: 24h
+//	    ttl_jitter: 10
+//	    sliding_ttl: 30m
+type storageOptions struct {
+	// spanKeys is how the keys are attached to the spans: none, hashed or plain
+	spanKeys string
+	// timeouts of the read, write and clear operations, 0 - unbounded
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	clearTimeout time.Duration
+	// defaultTTL is the TTL of the items stored without a timeout, 0 - no expiration
+	defaultTTL time.Duration
+	// maxTTL caps the TTL of the stored items, 0 - no limit
+	maxTTL time.Duration
+	// ttlJitter randomizes the TTL of the stored items by up to the percentage, in both directions
+	ttlJitter float64
+	// slidingTTL extends the expiring keys to now+slidingTTL when they are read, 0 - disabled
+	slidingTTL time.Duration
+}
+
+func defaultOptions() *storageOptions {
+	return &storageOptions{
+		spanKeys: spanKeysNone,
+	}
+}
+
+// parseOptions reads the options of the storage from its configuration section.
+func parseOptions(name string, section map[string]any) (*storageOptions, error) {
+	opts := defaultOptions()
+
+	if v, ok := section[tracing]; ok && v != nil {
+		t, ok := v.(map[string]any)
+		if !ok {
+			return nil, errors.Errorf("the %s section of the %s storage should be a map, got: %T", tracing, name, v)
+		}
+
+		if v, ok := t["keys"]; ok {
+			keys, _ := v.(string)
+			switch keys {
+			case spanKeysNone, spanKeysHashed, spanKeysPlain:
+				opts.spanKeys = keys
+			default:
+				return nil, errors.Errorf("wrong %s.keys value in the %s storage: %v, should be none, hashed or plain", tracing, name, v)
+			}
+		}
+	}
+
+	if v, ok := section[timeouts]; ok && v != nil {
+		t, ok := v.(map[string]any)
+		if !ok {
+			return nil, errors.Errorf("the %s section of the %s storage should be a map, got: %T", timeouts, name, v)
+		}
+
+		for key, dst := range map[string]*time.Duration{
+			"read":  &opts.readTimeout,
+			"write": &opts.writeTimeout,
+			"clear": &opts.clearTimeout,
+		} {
+			v, ok := t[key]
+			if !ok {
+				continue
+			}
+
+			str, _ := v.(string)
+			d, err := time.ParseDuration(str)
+			if err != nil || d < 0 {
+				return nil, errors.Errorf("wrong %s.%s value in the %s storage: %v, should be a duration, for example 500ms", timeouts, key, name, v)
+			}
+			*dst = d
+		}
+	}
+
+	for key, dst := range map[string]*time.Duration{
+		defaultTTL: &opts.defaultTTL,
+		maxTTL:     &opts.maxTTL,
+		slidingTTL: &opts.slidingTTL,
+	} {
+		v, ok := section[key]
+		if !ok {
+			continue
+		}
+
+		str, _ := v.(string)
+		d, err := time.ParseDuration(str)
+		if err != nil || d < 0 {
+			return nil, errors.Errorf("wrong %s value in the %s storage: %v, should be a duration, for example 1h", key, name, v)
+		}
+		*dst = d
+	}
+
+	if opts.maxTTL > 0 && opts.defaultTTL > opts.maxTTL {
+		return nil, errors.Errorf("%s of the %s storage exceeds its %s: %s > %s", defaultTTL, name, maxTTL, opts.defaultTTL, opts.maxTTL)
+	}
+
+	if opts.maxTTL > 0 && opts.slidingTTL > opts.maxTTL {
+		return nil, errors.Errorf("%s of the %s storage exceeds its %s: %s > %s", slidingTTL, name, maxTTL, opts.slidingTTL, opts.maxTTL)
+	}
+
+	if v, ok := section[ttlJitter]; ok {
+		var jitter float64
+		switch n := v.(type) {
+		case int:
+			jitter = float64(n)
+		case float64:
+			jitter = n
+		default:
+			jitter = -1
+		}
+
+		if jitter < 0 || jitter >= 100 {
+			return nil, errors.Errorf("wrong %s value in the %s storage: %v, should be a percentage from 0 to 100", ttlJitter, name, v)
+		}
+		opts.ttlJitter = jitter
+	}
+
+	return opts, nil
+}
+
+// timeout returns the timeout of the operation class, 0 when it's unbounded.
+func (o *storageOptions) timeout(class opClass) time.Duration {
+	switch class {
+	case opRead:
+		return o.readTimeout
+	case opWrite:
+		return o.writeTimeout
+	default:
+		return o.clearTimeout
+	}
+}
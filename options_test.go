@@ -0,0 +1,109 @@
+package kv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOptions(t *testing.T) {
+	opts, err := parseOptions(servedStorage, map[string]any{"driver": "memory"})
+	require.NoError(t, err)
+	assert.Equal(t, defaultOptions(), opts)
+
+	opts, err = parseOptions(servedStorage, map[string]any{
+		"driver":  "memory",
+		"tracing": map[string]any{"keys": "hashed"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, spanKeysHashed, opts.spanKeys)
+}
+
+func TestParseOptionsErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		section map[string]any
+		err     string
+	}{
+		{
+			name:    "tracing is not a map",
+			section: map[string]any{"tracing": "hashed"},
+			err:     "the tracing section of the south storage should be a map",
+		},
+		{
+			name:    "unknown keys mode",
+			section: map[string]any{"tracing": map[string]any{"keys": "encrypted"}},
+			err:     "wrong tracing.keys value in the south storage: encrypted",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseOptions(servedStorage, tc.section)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestServeRejectsWrongOptions(t *testing.T) {
+	p, _ := newInitedPlugin(t,
+		map[string]any{servedStorage: map[string]any{"driver": "fake", "tracing": map[string]any{"keys": "all"}}},
+		map[string]bool{servedStorage: true},
+	)
+	p.Collects()[0].Callback(&fakeConstructor{name: "fake", storage: &fakeStorage{}})
+
+	assert.ErrorContains(t, serveErr(p.Serve()), "wrong tracing.keys value")
+}
+
+func TestParseOptionsTimeouts(t *testing.T) {
+	opts, err := parseOptions(servedStorage, map[string]any{
+		"timeouts": map[string]any{"read": "500ms", "clear": "10s"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 500*time.Millisecond, opts.timeout(opRead))
+	assert.Equal(t, time.Duration(0), opts.timeout(opWrite))
+	assert.Equal(t, 10*time.Second, opts.timeout(opClear))
+
+	for _, tc := range []map[string]any{
+		{"read": "fast"},
+		{"write": "-1s"},
+		{"clear": 10},
+	} {
+		_, err := parseOptions(servedStorage, map[string]any{"timeouts": tc})
+		assert.ErrorContains(t, err, "in the south storage", tc)
+	}
+}
+
+func TestParseOptionsTTLPolicy(t *testing.T) {
+	opts, err := parseOptions(servedStorage, map[string]any{
+		"default_ttl": "1h",
+		"max_ttl":     "24h",
+		"ttl_jitter":  10,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, opts.defaultTTL)
+	assert.Equal(t, 24*time.Hour, opts.maxTTL)
+	assert.InDelta(t, 10.0, opts.ttlJitter, 0)
+
+	cases := []struct {
+		name    string
+		section map[string]any
+		err     string
+	}{
+		{name: "malformed default", section: map[string]any{"default_ttl": "forever"}, err: "wrong default_ttl value"},
+		{name: "negative max", section: map[string]any{"max_ttl": "-1h"}, err: "wrong max_ttl value"},
+		{name: "default above max", section: map[string]any{"default_ttl": "2h", "max_ttl": "1h"}, err: "default_ttl of the south storage exceeds its max_ttl"},
+		{name: "sliding above max", section: map[string]any{"sliding_ttl": "2h", "max_ttl": "1h"}, err: "sliding_ttl of the south storage exceeds its max_ttl"},
+		{name: "jitter out of range", section: map[string]any{"ttl_jitter": 100}, err: "wrong ttl_jitter value"},
+		{name: "jitter not a number", section: map[string]any{"ttl_jitter": "10%"}, err: "wrong ttl_jitter value"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseOptions(servedStorage, tc.section)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"reflect"
+	"sync"
 
 	"github.com/roadrunner-server/api-plugins/v6/kv"
 	"github.com/roadrunner-server/endure/v2/dep"
@@ -18,6 +20,13 @@ const (
 	driver string = "driver"
 	// config key used to detect local configuration for the driver
 	cfg string = "config"
+
+	// configuration sources a storage can be constructed from
+	sourceLocal  string = "local"
+	sourceGlobal string = "global"
+	sourceNone   string = "none"
+	// sourceRPC marks the storages registered at runtime with kv.AddStorage
+	sourceRPC string = "rpc"
 )
 
 type Configurer interface {
@@ -27,6 +36,15 @@ type Configurer interface {
 	Has(name string) bool
 }
 
+// ConfigReloader is an optional capability of the Configurer. The configuration
+// plugins parse their sources once, at Init. The ones implementing Reload parse
+// them again, so that a kv reload applies the current configuration. With the
+// others, kv.Reload and Reset fail with the unsupported code.
+type ConfigReloader interface {
+	// Reload re-reads the configuration sources.
+	Reload() error
+}
+
 // Tracer represents opentelemetry tracer (OTEL plugin)
 type Tracer interface {
 	Tracer() *sdktrace.TracerProvider
@@ -41,8 +59,14 @@ type Plugin struct {
 	log *slog.Logger
 	// constructors contain general storage constructors, such as boltdb, memory, memcached, redis.
 	constructors map[string]kv.Constructor
+	// updateMu serializes the changes of the registry: reloads and runtime registrations
+	updateMu sync.Mutex
 	// storages contain user-defined storages, such as boltdb-north, memcached-us and so on.
-	storages map[string]kv.Storage
+	storages *registry
+	// prometheus collectors of the operations
+	metrics *metrics
+	// stripes serialize the gateway-side fallbacks of the atomic operations
+	stripes *stripedMutex
 	// OTEL tracer
 	tracer *sdktrace.TracerProvider
 	// KV configuration
@@ -61,7 +85,9 @@ func (p *Plugin) Init(cfg Configurer, log Logger) error {
 		return errors.E(op, err)
 	}
 	p.constructors = make(map[string]kv.Constructor, 5)
-	p.storages = make(map[string]kv.Storage, 5)
+	p.storages = newRegistry()
+	p.stripes = newStripedMutex()
+	p.metrics = newMetrics()
 	p.log = log.NamedLogger(PluginName)
 	// NOOP tracer
 	p.tracer = sdktrace.NewTracerProvider()
@@ -74,90 +100,156 @@ func (p *Plugin) Serve() chan error {
 	errCh := make(chan error, 1)
 	const op = errors.Op("kv_plugin_serve")
 
+	storages, skipped, err := p.construct(context.Background(), p.cfg.Data, nil)
+	if err != nil {
+		errCh <- errors.E(op, err)
+		return errCh
+	}
+
+	p.storages.swap(storages, skipped)
+
+	return errCh
+}
+
+// construct builds the storages declared in the kv configuration section. The
+// running storages whose configuration didn't change are reused as is. On error,
+// the storages constructed by this call are stopped.
+func (p *Plugin) construct(ctx context.Context, data map[string]any, running map[string]*storageEntry) (map[string]*storageEntry, []*SkippedStorage, error) {
 	// key - storage name in the config
 	// value - storage
 	// For this config we should have 3 constructors: memory, boltdb and memcached but 4 KVs: default, boltdb-south, boltdb-north and memcached
 	// when user requests, for example, boltdb-south, we should provide that particular pre-configured storage
 
-	ctx := context.Background()
+	storages := make(map[string]*storageEntry, len(data))
+	skipped := make([]*SkippedStorage, 0)
+	// the composite storages are built after the storages they reference
+	pending := make([]*compositeSection, 0)
+
+	err := func() error {
+		for k, v := range data {
+			// for example, if the key didn't properly format (yaml)
+			if v == nil {
+				skipped = append(skipped, &SkippedStorage{Name: k, Reason: "empty section"})
+				continue
+			}
 
-	for k, v := range p.cfg.Data {
-		// for example, if the key didn't properly format (yaml)
-		if v == nil {
-			continue
-		}
+			// check type of the v
+			// should be a map[string]any
+			t, ok := v.(map[string]any)
+			if !ok {
+				p.log.Warn("wrong type detected in the configuration, please, check yaml indentation", "storage", k)
+				skipped = append(skipped, &SkippedStorage{Name: k, Reason: fmt.Sprintf("wrong section type: %T", v)})
+				continue
+			}
 
-		// check type of the v
-		// should be a map[string]any
-		t, ok := v.(map[string]any)
-		if !ok {
-			p.log.Warn("wrong type detected in the configuration, please, check yaml indentation", "storage", k)
-			continue
-		}
+			if _, ok := t[driver]; !ok {
+				return errors.Errorf("could not find mandatory driver field in the %s storage", k)
+			}
 
-		if _, ok := t[driver]; !ok {
-			errCh <- errors.E(op, errors.Errorf("could not find mandatory driver field in the %s storage", k))
-			return errCh
-		}
+			// config key for the particular sub-driver kv.memcached.config
+			configKey := fmt.Sprintf("%s.%s.%s", PluginName, k, cfg)
+			// at this point we know, that driver field present in the configuration
+			drName := t[driver]
+
+			// driver name should be a string
+			drStr, ok := drName.(string)
+			if !ok {
+				p.log.Warn("driver field is not a string, skipping storage", "storage", k, "driver_type", fmt.Sprintf("%T", drName))
+				skipped = append(skipped, &SkippedStorage{Name: k, Reason: fmt.Sprintf("driver field is not a string: %T", drName)})
+				continue
+			}
 
-		// config key for the particular sub-driver kv.memcached.config
-		configKey := fmt.Sprintf("%s.%s.%s", PluginName, k, cfg)
-		// at this point we know, that driver field present in the configuration
-		drName := t[driver]
+			opts, err := parseOptions(k, t)
+			if err != nil {
+				return err
+			}
 
-		// driver name should be a string
-		drStr, ok := drName.(string)
-		if !ok {
-			p.log.Warn("driver field is not a string, skipping storage", "storage", k, "driver_type", fmt.Sprintf("%T", drName))
-			continue
-		}
+			info := &StorageInfo{Name: k, Driver: drStr}
+			section := []any{t}
 
-		switch {
-		// local configuration section key
-		case p.cfgPlugin.Has(configKey):
-			err := p.checkAndSaveStorage(ctx, drStr, k, configKey)
-			if err != nil {
-				errCh <- errors.E(op, err)
-				return errCh
+			if parse, ok := composites[drStr]; ok {
+				spec, err := parse(k, t)
+				if err != nil {
+					return err
+				}
+
+				info.Source = sourceComposite
+				pending = append(pending, &compositeSection{info: info, opts: opts, section: section, spec: spec})
+				continue
 			}
-			// try global then
-		case p.cfgPlugin.Has(k):
-			err := p.checkAndSaveStorage(ctx, drStr, k, k)
-			if err != nil {
-				errCh <- errors.E(op, err)
-				return errCh
+
+			switch {
+			// local configuration section key
+			case p.cfgPlugin.Has(configKey):
+				info.Source, info.ConfigKey = sourceLocal, configKey
+				// try global then
+			case p.cfgPlugin.Has(k):
+				info.Source, info.ConfigKey = sourceGlobal, k
+				// the global section lives outside the kv one, so its content is a part of the snapshot
+				var global map[string]any
+				if err := p.cfgPlugin.UnmarshalKey(k, &global); err != nil {
+					return err
+				}
+				section = append(section, global)
+			default:
+				p.log.Warn("can't find local or global configuration, this section will be skipped", "local", configKey, "global", k)
+				info.Source = sourceNone
 			}
-		default:
-			p.log.Warn("can't find local or global configuration, this section will be skipped", "local", configKey, "global", k)
 
-			err := p.checkAndSaveStorage(ctx, drStr, k, "")
-			if err != nil {
-				errCh <- errors.E(op, err)
-				return errCh
+			if old, ok := running[k]; ok && *old.info == *info && reflect.DeepEqual(old.section, section) {
+				storages[k] = old
+				continue
+			}
+
+			if err := p.checkAndSaveStorage(ctx, storages, info, opts, section); err != nil {
+				return err
+			}
+		}
+
+		return p.constructComposites(storages, pending, running)
+	}()
+
+	if err != nil {
+		for name, entry := range storages {
+			if running[name] != entry {
+				entry.stop(ctx)
 			}
 		}
+
+		return nil, nil, err
 	}
 
-	return errCh
+	return storages, skipped, nil
 }
 
-func (p *Plugin) checkAndSaveStorage(ctx context.Context, drStr string, name, cfgkey string) error {
-	if _, ok := p.constructors[drStr]; !ok {
-		return errors.Errorf("no such constructor was registered: %s, registered: %v", drStr, p.constructors)
+func (p *Plugin) checkAndSaveStorage(ctx context.Context, storages map[string]*storageEntry, info *StorageInfo, opts *storageOptions, section []any) error {
+	if _, ok := p.constructors[info.Driver]; !ok {
+		return errors.Errorf("no such constructor was registered: %s, registered: %v", info.Driver, p.constructors)
 	}
 
 	// use only key for the driver registration, for example, rr-boltdb should be globally available
-	storage, err := p.constructors[drStr].KvFromConfig(ctx, cfgkey)
+	storage, err := p.constructors[info.Driver].KvFromConfig(ctx, info.ConfigKey)
 	if err != nil {
 		return err
 	}
 
 	// save the storage
-	p.storages[name] = storage
+	storages[info.Name] = p.newEntry(storage, info, opts, section)
 
 	return nil
 }
 
+// newEntry wraps the constructed storage, starting the background work its
+// options ask for.
+func (p *Plugin) newEntry(st kv.Storage, info *StorageInfo, opts *storageOptions, section []any) *storageEntry {
+	entry := newStorageEntry(st, info, opts, section)
+	if opts.slidingTTL > 0 {
+		entry.slider = newSlider(entry, p.log, p.metrics)
+	}
+
+	return entry
+}
+
 func (p *Plugin) Weight() uint {
 	return 10
 }
@@ -166,12 +258,17 @@ func (p *Plugin) Stop(ctx context.Context) error {
 	stopCh := make(chan struct{}, 1)
 
 	go func() {
+		// a reload running concurrently would register the retired storages again
+		p.updateMu.Lock()
+		defer p.updateMu.Unlock()
+
+		storages := p.storages.swap(make(map[string]*storageEntry), nil)
+
 		// stop all attached storages
-		for k := range p.storages {
-			p.storages[k].Stop(ctx)
+		for k := range storages {
+			storages[k].retire(ctx)
 		}
 
-		clear(p.storages)
 		clear(p.constructors)
 		stopCh <- struct{}{}
 	}()
@@ -203,7 +300,8 @@ func (p *Plugin) Name() string {
 
 func (p *Plugin) RPC() any {
 	return &rpc{
-		pl:     p,
-		tracer: p.tracer.Tracer(tracerName),
+		pl:      p,
+		tracer:  p.tracer.Tracer(tracerName),
+		metrics: p.metrics,
 	}
 }
@@ -134,7 +134,7 @@ func TestPluginServeBranches(t *testing.T) {
 				assert.Truef(t, h.hasWarn(tc.warnSub), "expected a warn record containing %q", tc.warnSub)
 			}
 
-			assert.ElementsMatch(t, tc.wantStorages, slices.Collect(maps.Keys(p.storages)))
+			assert.ElementsMatch(t, tc.wantStorages, slices.Collect(maps.Keys(p.storages.snapshot())))
 		})
 	}
 }
@@ -211,7 +211,7 @@ func TestPluginStopStopsStorages(t *testing.T) {
 	for _, st := range ctor.created {
 		assert.Equal(t, 1, st.recorded().stopCalls)
 	}
-	assert.Empty(t, p.storages)
+	assert.Empty(t, p.storages.snapshot())
 }
 
 func TestPluginStopCancelledContext(t *testing.T) {
@@ -0,0 +1,189 @@
+package kv
+
+import (
+	"context"
+	stderr "errors"
+	"fmt"
+	"maps"
+	"sync"
+	"sync/atomic"
+
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+)
+
+var errStorageExists = stderr.New("storage already registered")
+
+// storageEntry is a constructed storage with the information about its
+// configuration and the number of calls currently using it.
+type storageEntry struct {
+	kv.Storage
+	info *StorageInfo
+	opts *storageOptions
+	// slider extends the expiry of the read keys, nil without the sliding_ttl option
+	slider *slider
+	// deps are the storages a composite is built on, held until it stops
+	deps []*storageEntry
+	// section is the configuration snapshot used to detect changes on reload
+	section []any
+
+	mu sync.Mutex
+	// refs counts the callers holding the storage
+	refs int
+	// retired is set once the entry is removed from the registry
+	retired bool
+	// stopped is closed when the storage has been stopped
+	stopped chan struct{}
+	// overdue counts the calls left running past their deadline, see bounded
+	overdue atomic.Int64
+	// stopOnce guards stop, the entry retired by a concurrent reload and Stop
+	// would be stopped twice otherwise
+	stopOnce sync.Once
+}
+
+func newStorageEntry(st kv.Storage, info *StorageInfo, opts *storageOptions, section []any) *storageEntry {
+	return &storageEntry{
+		Storage: st,
+		info:    info,
+		opts:    opts,
+		section: section,
+		stopped: make(chan struct{}),
+	}
+}
+
+// release drops the reference taken by registry.acquire. The last caller
+// releasing a retired storage stops it.
+func (e *storageEntry) release() {
+	e.mu.Lock()
+	e.refs--
+	last := e.retired && e.refs == 0
+	e.mu.Unlock()
+
+	if last {
+		e.stop(context.Background())
+	}
+}
+
+// hold takes one more reference on the entry the caller already holds.
+func (e *storageEntry) hold() {
+	e.mu.Lock()
+	e.refs++
+	e.mu.Unlock()
+}
+
+// retire marks the entry removed from the registry and stops the storage right
+// away when nobody holds it.
+func (e *storageEntry) retire(ctx context.Context) {
+	e.mu.Lock()
+	e.retired = true
+	idle := e.refs == 0
+	e.mu.Unlock()
+
+	if idle {
+		e.stop(ctx)
+	}
+}
+
+// stop stops the storage and releases its dependencies, only the first call
+// has an effect.
+func (e *storageEntry) stop(ctx context.Context) {
+	e.stopOnce.Do(func() {
+		if e.slider != nil {
+			e.slider.stop()
+		}
+		e.Stop(ctx)
+		close(e.stopped)
+
+		for _, dep := range e.deps {
+			dep.release()
+		}
+	})
+}
+
+// registry holds the named storages. Lookups run concurrently, and every storage
+// handed out is reference counted, so the storage removed from the registry is
+// stopped only after the last caller released it.
+type registry struct {
+	mu      sync.RWMutex
+	entries map[string]*storageEntry
+	// skipped lists the configuration sections no storage was constructed for
+	skipped []*SkippedStorage
+}
+
+func newRegistry() *registry {
+	return &registry{entries: make(map[string]*storageEntry, 5)}
+}
+
+// acquire returns the entry registered under the name with a reference taken,
+// the caller should release it once done.
+func (r *registry) acquire(name string) (*storageEntry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	entry, ok := r.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errNoSuchStore, name)
+	}
+
+	entry.mu.Lock()
+	entry.refs++
+	entry.mu.Unlock()
+
+	return entry, nil
+}
+
+// register adds the entry under its name.
+func (r *registry) register(entry *storageEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.entries[entry.info.Name]; ok {
+		return fmt.Errorf("%w: %s", errStorageExists, entry.info.Name)
+	}
+
+	r.entries[entry.info.Name] = entry
+	return nil
+}
+
+// unregister removes the storage from the registry and retires it.
+func (r *registry) unregister(ctx context.Context, name string) (*storageEntry, error) {
+	r.mu.Lock()
+	entry, ok := r.entries[name]
+	delete(r.entries, name)
+	r.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errNoSuchStore, name)
+	}
+
+	entry.retire(ctx)
+	return entry, nil
+}
+
+// swap atomically replaces the registered storages and returns the previous ones.
+// Retiring the entries which are not registered anymore is up to the caller.
+func (r *registry) swap(entries map[string]*storageEntry, skipped []*SkippedStorage) map[string]*storageEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := r.entries
+	r.entries = entries
+	r.skipped = skipped
+
+	return old
+}
+
+// snapshot returns a copy of the registered storages.
+func (r *registry) snapshot() map[string]*storageEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return maps.Clone(r.entries)
+}
+
+// skippedSections returns the configuration sections no storage was constructed for.
+func (r *registry) skippedSections() []*SkippedStorage {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.skipped
+}
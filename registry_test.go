@@ -0,0 +1,88 @@
+package kv
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryRefCounting(t *testing.T) {
+	reg := newRegistry()
+	st := &fakeStorage{}
+	require.NoError(t, reg.register(newStorageEntry(st, &StorageInfo{Name: servedStorage}, defaultOptions(), nil)))
+	require.ErrorIs(t, reg.register(newStorageEntry(&fakeStorage{}, &StorageInfo{Name: servedStorage}, defaultOptions(), nil)), errStorageExists)
+
+	first, err := reg.acquire(servedStorage)
+	require.NoError(t, err)
+	second, err := reg.acquire(servedStorage)
+	require.NoError(t, err)
+
+	entry, err := reg.unregister(t.Context(), servedStorage)
+	require.NoError(t, err)
+	_, err = reg.acquire(servedStorage)
+	require.ErrorIs(t, err, errNoSuchStore)
+
+	// the storage outlives its registration while somebody holds it
+	first.release()
+	assert.Equal(t, 0, st.recorded().stopCalls)
+	second.release()
+	assert.Equal(t, 1, st.recorded().stopCalls)
+	<-entry.stopped
+
+	_, err = reg.unregister(t.Context(), servedStorage)
+	require.ErrorIs(t, err, errNoSuchStore)
+}
+
+func TestRegistryConcurrentAccess(t *testing.T) {
+	reg := newRegistry()
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			for range 100 {
+				entry, err := reg.acquire(servedStorage)
+				if err == nil {
+					entry.release()
+				}
+			}
+		})
+	}
+
+	entries := make([]*storageEntry, 0, 50)
+	for range 50 {
+		entry := newStorageEntry(&fakeStorage{}, &StorageInfo{Name: servedStorage}, defaultOptions(), nil)
+		entries = append(entries, entry)
+		require.NoError(t, reg.register(entry))
+		_, err := reg.unregister(t.Context(), servedStorage)
+		require.NoError(t, err)
+	}
+	wg.Wait()
+
+	for _, entry := range entries {
+		<-entry.stopped
+		assert.Equal(t, 1, entry.Storage.(*fakeStorage).recorded().stopCalls)
+	}
+}
+
+func TestStorageEntryStopsOnce(t *testing.T) {
+	st := &fakeStorage{}
+	dep := newStorageEntry(&fakeStorage{}, &StorageInfo{Name: "dep"}, defaultOptions(), nil)
+	dep.hold()
+	entry := newStorageEntry(st, &StorageInfo{Name: servedStorage}, defaultOptions(), nil)
+	entry.deps = []*storageEntry{dep}
+	dep.retire(t.Context())
+
+	// a reload and Stop racing may both retire the same entry
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() { entry.retire(t.Context()) })
+	}
+	wg.Wait()
+
+	<-entry.stopped
+	<-dep.stopped
+	assert.Equal(t, 1, st.recorded().stopCalls)
+	assert.Equal(t, 1, dep.Storage.(*fakeStorage).recorded().stopCalls)
+}
@@ -0,0 +1,124 @@
+package kv
+
+import (
+	"context"
+	stderr "errors"
+	"slices"
+
+	"github.com/roadrunner-server/errors"
+)
+
+var errConfigReload = stderr.New("the configuration plugin can't re-read its sources")
+
+// ReloadResponse is the answer of the kv.Reload RPC call, listing the storage
+// names by what the reload did with them.
+type ReloadResponse struct {
+	Added     []string `json:"added"`
+	Replaced  []string `json:"replaced"`
+	Removed   []string `json:"removed"`
+	Unchanged []string `json:"unchanged"`
+}
+
+// Reset re-reads the kv configuration section and applies it to the running
+// storages. It's invoked by the RoadRunner resetter plugin. The configuration
+// plugin should implement the ConfigReloader, otherwise the reload fails with
+// the unsupported code.
+func (p *Plugin) Reset() error {
+	_, err := p.reload(context.Background())
+	return err
+}
+
+// reload constructs the added and changed storages, swaps them in atomically and
+// retires the removed and replaced ones, which are stopped once the RPC calls
+// using them are done. On error, the running storages are left untouched.
+func (p *Plugin) reload(ctx context.Context) (*ReloadResponse, error) {
+	const op = errors.Op("kv_plugin_reload")
+
+	p.updateMu.Lock()
+	defer p.updateMu.Unlock()
+
+	// applying the configuration read at startup again would report a reload
+	// which changed nothing
+	rl, ok := p.cfgPlugin.(ConfigReloader)
+	if !ok {
+		return nil, errors.E(op, errConfigReload)
+	}
+
+	if err := rl.Reload(); err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	var data map[string]any
+	if err := p.cfgPlugin.UnmarshalKey(PluginName, &data); err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	running := p.storages.snapshot()
+
+	storages, skipped, err := p.construct(ctx, data, running)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	// the storages registered over RPC are not a part of the configuration, they
+	// survive the reload unless the configuration declares the same name
+	for name, entry := range running {
+		if _, ok := storages[name]; !ok && entry.info.Source == sourceRPC {
+			storages[name] = entry
+		}
+	}
+
+	p.storages.swap(storages, skipped)
+	p.cfg.Data = data
+
+	res := &ReloadResponse{}
+	for name, entry := range storages {
+		old, ok := running[name]
+		switch {
+		case !ok:
+			res.Added = append(res.Added, name)
+		case old != entry:
+			res.Replaced = append(res.Replaced, name)
+		default:
+			res.Unchanged = append(res.Unchanged, name)
+		}
+	}
+
+	for name, old := range running {
+		entry, ok := storages[name]
+		if !ok {
+			res.Removed = append(res.Removed, name)
+		}
+
+		if entry != old {
+			// no new calls can reach the old storage after the swap, it's stopped
+			// once the in-flight ones release it
+			old.retire(ctx)
+		}
+	}
+
+	slices.Sort(res.Added)
+	slices.Sort(res.Replaced)
+	slices.Sort(res.Removed)
+	slices.Sort(res.Unchanged)
+
+	p.log.Info("kv configuration reloaded", "added", res.Added, "replaced", res.Replaced, "removed", res.Removed)
+
+	return res, nil
+}
+
+// Reload applies the current kv configuration section without restarting
+// RoadRunner, see Reset.
+func (r *rpc) Reload(_ bool, out *ReloadResponse) error {
+	ctx, span := r.tracer.Start(context.Background(), "kv:reload")
+	defer span.End()
+
+	res, err := r.pl.reload(ctx)
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+
+	*out = *res
+	return nil
+}
@@ -0,0 +1,230 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// servedFake initializes and serves a plugin over the mutable configuration,
+// every storage is built by the returned constructor.
+func servedFake(t *testing.T, c Configurer) (*Plugin, *fakeConstructor) {
+	t.Helper()
+
+	p := &Plugin{}
+	require.NoError(t, p.Init(c, &mockLogger{h: &capHandler{}}))
+
+	ctor := &fakeConstructor{name: "fake"}
+	p.Collects()[0].Callback(ctor)
+	require.NoError(t, serveErr(p.Serve()))
+
+	return p, ctor
+}
+
+func TestPluginReload(t *testing.T) {
+	c := &mockCfg{
+		data: map[string]any{
+			"north": map[string]any{"driver": "fake"},
+			"south": map[string]any{"driver": "fake", "config": map[string]any{"size": 1}},
+			"west":  map[string]any{"driver": "fake"},
+		},
+		has: map[string]bool{PluginName: true, "kv.south.config": true},
+	}
+	p, ctor := servedFake(t, c)
+	require.Len(t, ctor.created, 3)
+
+	before := map[string]*fakeStorage{}
+	for name, entry := range p.storages.snapshot() {
+		before[name] = entry.Storage.(*fakeStorage)
+	}
+
+	r, ok := p.RPC().(*rpc)
+	require.True(t, ok)
+
+	// a call still using west holds its stop back
+	entry, err := r.lookupStorage(context.Background(), "west")
+	require.NoError(t, err)
+
+	c.data = map[string]any{
+		"north": map[string]any{"driver": "fake"},
+		"south": map[string]any{"driver": "fake", "config": map[string]any{"size": 2}},
+		"east":  map[string]any{"driver": "fake"},
+	}
+
+	done := make(chan *ReloadResponse)
+	go func() {
+		var out ReloadResponse
+		assert.NoError(t, r.Reload(true, &out))
+		done <- &out
+	}()
+
+	require.Eventually(t, func() bool { return before["south"].recorded().stopCalls == 1 }, time.Second, time.Millisecond*10)
+	assert.Equal(t, 0, before["west"].recorded().stopCalls)
+
+	// the new configuration already serves the calls
+	require.ErrorIs(t, r.Clear(&kvV1.Request{Storage: "west"}, &kvV1.Response{}), errNoSuchStore)
+	require.NoError(t, r.Clear(&kvV1.Request{Storage: "east"}, &kvV1.Response{}))
+
+	entry.release()
+	res := <-done
+
+	assert.Equal(t, &ReloadResponse{
+		Added:     []string{"east"},
+		Replaced:  []string{"south"},
+		Removed:   []string{"west"},
+		Unchanged: []string{"north"},
+	}, res)
+	assert.Equal(t, 1, before["west"].recorded().stopCalls)
+	assert.Equal(t, 0, before["north"].recorded().stopCalls)
+	assert.Len(t, ctor.created, 5)
+}
+
+func TestPluginReloadFailureKeepsStorages(t *testing.T) {
+	c := &mockCfg{
+		data: map[string]any{"north": map[string]any{"driver": "fake"}},
+		has:  map[string]bool{PluginName: true},
+	}
+	p, ctor := servedFake(t, c)
+
+	c.data = map[string]any{
+		"north": map[string]any{"driver": "fake", "config": map[string]any{}},
+		"south": map[string]any{"driver": "nope"},
+	}
+	err := p.Reset()
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "kv_plugin_reload")
+
+	// when north was rebuilt before the failure, the new instance is stopped, the
+	// running one keeps serving either way
+	assert.Equal(t, 0, ctor.created[0].recorded().stopCalls)
+	for _, st := range ctor.created[1:] {
+		assert.Equal(t, 1, st.recorded().stopCalls)
+	}
+
+	storages := p.storages.snapshot()
+	require.Len(t, storages, 1)
+	assert.Same(t, ctor.created[0], storages["north"].Storage)
+}
+
+// fileCfg is a configuration plugin backed by a JSON file. As the RoadRunner one,
+// it parses the file once and serves the parsed data until Reload.
+type fileCfg struct {
+	path string
+	data map[string]any
+}
+
+func (c *fileCfg) Reload() error {
+	buf, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf, &c.data)
+}
+
+// lookup returns the value of the dotted key.
+func (c *fileCfg) lookup(name string) (any, bool) {
+	var val any = c.data
+	for _, part := range strings.Split(name, ".") {
+		m, ok := val.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if val, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+
+	return val, true
+}
+
+func (c *fileCfg) UnmarshalKey(name string, out any) error {
+	val, _ := c.lookup(name)
+	buf, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf, out)
+}
+
+func (c *fileCfg) Has(name string) bool {
+	_, ok := c.lookup(name)
+	return ok
+}
+
+// writeConfig writes the kv section into the configuration file.
+func writeConfig(t *testing.T, path string, kv map[string]any) {
+	t.Helper()
+
+	buf, err := json.Marshal(map[string]any{PluginName: kv})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, buf, 0o600))
+}
+
+func TestPluginReloadRereadsConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rr.json")
+	writeConfig(t, path, map[string]any{"north": map[string]any{"driver": "fake"}})
+
+	c := &fileCfg{path: path}
+	require.NoError(t, c.Reload())
+	p, _ := servedFake(t, c)
+
+	r, ok := p.RPC().(*rpc)
+	require.True(t, ok)
+
+	writeConfig(t, path, map[string]any{"north": map[string]any{"driver": "fake"}, "east": map[string]any{"driver": "fake"}})
+	var out ReloadResponse
+	require.NoError(t, r.Reload(true, &out))
+	assert.Equal(t, []string{"east"}, out.Added)
+
+	writeConfig(t, path, map[string]any{"east": map[string]any{"driver": "fake"}})
+	require.NoError(t, p.Reset())
+	assert.Equal(t, []string{"east"}, slices.Collect(maps.Keys(p.storages.snapshot())))
+
+	// a broken file fails the reload, the running storages keep serving
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+	assert.ErrorContains(t, p.Reset(), "kv_plugin_reload")
+	assert.Equal(t, []string{"east"}, slices.Collect(maps.Keys(p.storages.snapshot())))
+}
+
+// staticCfg hides the Reload of the file configuration.
+type staticCfg struct {
+	Configurer
+}
+
+func TestPluginReloadWithoutConfigReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rr.json")
+	writeConfig(t, path, map[string]any{"north": map[string]any{"driver": "fake"}})
+
+	c := &fileCfg{path: path}
+	require.NoError(t, c.Reload())
+	h := &capHandler{}
+	p := &Plugin{}
+	require.NoError(t, p.Init(staticCfg{c}, &mockLogger{h: h}))
+	p.Collects()[0].Callback(&fakeConstructor{name: "fake"})
+	require.NoError(t, serveErr(p.Serve()))
+
+	// the changed file can't be read again, the reload fails instead of
+	// applying the configuration read at startup
+	writeConfig(t, path, map[string]any{"east": map[string]any{"driver": "fake"}})
+	r, ok := p.RPC().(*rpc)
+	require.True(t, ok)
+
+	err := r.Reload(true, &ReloadResponse{})
+	assert.ErrorContains(t, err, errConfigReload.Error())
+	assert.Equal(t, CodeUnsupported, codeOf(err))
+	assert.Equal(t, CodeUnsupported, codeOf(p.Reset()))
+
+	assert.Equal(t, []string{"north"}, slices.Sorted(maps.Keys(p.storages.snapshot())))
+}
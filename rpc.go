@@ -3,10 +3,9 @@ package kv
 import (
 	"context"
 	stderr "errors"
-	"fmt"
+	"time"
 
 	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
-	"github.com/roadrunner-server/api-plugins/v6/kv"
 	"github.com/roadrunner-server/errors"
 	"go.opentelemetry.io/otel/trace"
 )
@@ -16,22 +15,34 @@ const tracerName = "kv"
 var (
 	errEmptyStorage = stderr.New("no storage provided")
 	errNoSuchStore  = stderr.New("no such storage")
+	errSingleKey    = stderr.New("exactly one key should be provided")
 )
 
 type rpc struct {
-	pl     *Plugin
-	tracer trace.Tracer
+	pl      *Plugin
+	tracer  trace.Tracer
+	metrics *metrics
 }
 
-func (r *rpc) lookupStorage(name string) (kv.Storage, error) {
+// lookupStorage returns the storage registered under the name. The caller should
+// release the entry once it's done with the storage, until then the storage is
+// not stopped by a reload or an unregistration. The span of the ctx is annotated
+// with the storage and driver names.
+func (r *rpc) lookupStorage(ctx context.Context, name string) (*storageEntry, error) {
 	if name == "" {
 		return nil, errEmptyStorage
 	}
-	st, ok := r.pl.storages[name]
-	if !ok {
-		return nil, fmt.Errorf("%w: %s", errNoSuchStore, name)
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attrStorage.String(name))
+
+	entry, err := r.pl.storages.acquire(name)
+	if err != nil {
+		return nil, err
 	}
-	return st, nil
+
+	span.SetAttributes(attrDriver.String(entry.info.Driver))
+	return entry, nil
 }
 
 func keysOf(items []*kvV1.Item) []string {
@@ -43,115 +54,331 @@ func keysOf(items []*kvV1.Item) []string {
 }
 
 func (r *rpc) Has(in *kvV1.Request, out *kvV1.Response) error {
+	return r.has(context.Background(), in, out)
+}
+
+func (r *rpc) has(ctx context.Context, in *kvV1.Request, out *kvV1.Response) error {
 	const op = errors.Op("rpc_has")
 
-	ctx, span := r.tracer.Start(context.Background(), "kv:has")
+	in, md, err := requestMetadata(in)
+	ctx, span := r.tracer.Start(requestContext(ctx, md), "kv:has")
 	defer span.End()
 
-	st, err := r.lookupStorage(in.GetStorage())
 	if err != nil {
-		span.RecordError(err)
-		return err
+		recordError(span, err)
+		return rpcError(op, err)
 	}
 
+	ctx, cancel, err := withClientTimeout(ctx, md)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.GetStorage())
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+
 	keys := keysOf(in.GetItems())
+	entry.traceKeys(span, keys)
 
-	ret, err := st.Has(ctx, keys...)
+	start := time.Now()
+	ret, err := bounded(ctx, entry, opRead, func(ctx context.Context) (map[string]bool, error) {
+		return entry.Has(ctx, keys...)
+	})
+	r.metrics.observe(in.GetStorage(), "has", start, len(keys), err)
 	if err != nil {
-		span.RecordError(err)
-		return errors.E(op, err)
+		entry.recordError(span, err)
+		return rpcError(op, err)
 	}
 
 	out.Items = make([]*kvV1.Item, 0, len(ret))
 	for k := range ret {
 		out.Items = append(out.Items, &kvV1.Item{Key: k})
 	}
+	r.metrics.observeHits(in.GetStorage(), "has", len(out.Items), len(keys))
+	span.SetAttributes(attrHits.Int(len(out.Items)))
 	return nil
 }
 
 func (r *rpc) Set(in *kvV1.Request, _ *kvV1.Response) error {
+	return r.set(context.Background(), in, nil)
+}
+
+func (r *rpc) set(ctx context.Context, in *kvV1.Request, _ *kvV1.Response) error {
 	const op = errors.Op("rpc_set")
 
-	ctx, span := r.tracer.Start(context.Background(), "kv:set")
+	in, md, err := requestMetadata(in)
+	ctx, span := r.tracer.Start(requestContext(ctx, md), "kv:set")
+	defer span.End()
+
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	ctx, cancel, err := withClientTimeout(ctx, md)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.GetStorage())
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+
+	entry.traceKeys(span, keysOf(in.GetItems()))
+
+	// the timeouts are checked before any storage call
+	items, err := entry.itemsFrom(in.GetItems())
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	start := time.Now()
+	err = boundedErr(ctx, entry, opWrite, func(ctx context.Context) error {
+		return entry.Set(ctx, items...)
+	})
+	r.metrics.observe(in.GetStorage(), "set", start, len(in.GetItems()), err)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+	r.metrics.observeBytes(in.GetStorage(), "set", valuesSize(in.GetItems()))
+	span.SetAttributes(attrBytes.Int(valuesSize(in.GetItems())))
+	return nil
+}
+
+// Get loads the value of a single key. A missing key is answered with no items,
+// while an existing key is answered with exactly one item, even when its value
+// is empty.
+func (r *rpc) Get(in *kvV1.Request, out *kvV1.Response) error {
+	return r.get(context.Background(), in, out)
+}
+
+func (r *rpc) get(ctx context.Context, in *kvV1.Request, out *kvV1.Response) error {
+	const op = errors.Op("rpc_get")
+
+	in, md, err := requestMetadata(in)
+	ctx, span := r.tracer.Start(requestContext(ctx, md), "kv:get")
 	defer span.End()
 
-	st, err := r.lookupStorage(in.GetStorage())
 	if err != nil {
-		span.RecordError(err)
-		return err
+		recordError(span, err)
+		return rpcError(op, err)
 	}
 
-	if err := st.Set(ctx, from(in.GetItems())...); err != nil {
-		span.RecordError(err)
-		return errors.E(op, err)
+	ctx, cancel, err := withClientTimeout(ctx, md)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
 	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.GetStorage())
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+
+	if len(in.GetItems()) != 1 {
+		entry.recordError(span, errSingleKey)
+		return rpcError(op, errSingleKey)
+	}
+
+	key := in.GetItems()[0].GetKey()
+	entry.traceKeys(span, []string{key})
+
+	start := time.Now()
+	ret, err := bounded(ctx, entry, opRead, func(ctx context.Context) ([]byte, error) {
+		return entry.Get(ctx, key)
+	})
+	r.metrics.observe(in.GetStorage(), "get", start, 1, err)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	// drivers report a missing key with a nil slice, an empty value is non-nil
+	if ret == nil {
+		r.metrics.observeHits(in.GetStorage(), "get", 0, 1)
+		span.SetAttributes(attrHits.Int(0))
+		out.Items = make([]*kvV1.Item, 0)
+		return nil
+	}
+
+	entry.slide(key)
+	r.metrics.observeHits(in.GetStorage(), "get", 1, 1)
+	r.metrics.observeBytes(in.GetStorage(), "get", len(ret))
+	span.SetAttributes(attrHits.Int(1), attrBytes.Int(len(ret)))
+	out.Items = []*kvV1.Item{{Key: key, Value: ret}}
 	return nil
 }
 
 func (r *rpc) MGet(in *kvV1.Request, out *kvV1.Response) error {
+	return r.mget(context.Background(), in, out)
+}
+
+func (r *rpc) mget(ctx context.Context, in *kvV1.Request, out *kvV1.Response) error {
 	const op = errors.Op("rpc_mget")
 
-	ctx, span := r.tracer.Start(context.Background(), "kv:mget")
+	in, md, err := requestMetadata(in)
+	ctx, span := r.tracer.Start(requestContext(ctx, md), "kv:mget")
 	defer span.End()
 
-	st, err := r.lookupStorage(in.GetStorage())
 	if err != nil {
-		span.RecordError(err)
-		return err
+		recordError(span, err)
+		return rpcError(op, err)
 	}
 
+	ctx, cancel, err := withClientTimeout(ctx, md)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.GetStorage())
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+
 	keys := keysOf(in.GetItems())
+	entry.traceKeys(span, keys)
 
-	ret, err := st.MGet(ctx, keys...)
+	start := time.Now()
+	ret, err := bounded(ctx, entry, opRead, func(ctx context.Context) (map[string][]byte, error) {
+		return entry.MGet(ctx, keys...)
+	})
+	r.metrics.observe(in.GetStorage(), "mget", start, len(keys), err)
 	if err != nil {
-		span.RecordError(err)
-		return errors.E(op, err)
+		entry.recordError(span, err)
+		return rpcError(op, err)
 	}
 
+	hits := 0
 	out.Items = make([]*kvV1.Item, 0, len(ret))
 	for k := range ret {
+		// the keys the driver reports with a nil value are answered as they are,
+		// MGetDetailed tells them apart
 		out.Items = append(out.Items, &kvV1.Item{Key: k, Value: ret[k]})
+		if ret[k] != nil {
+			hits++
+			entry.slide(k)
+		}
 	}
+	r.metrics.observeHits(in.GetStorage(), "mget", hits, len(keys))
+	r.metrics.observeBytes(in.GetStorage(), "mget", valuesSize(out.Items))
+	span.SetAttributes(attrHits.Int(hits), attrBytes.Int(valuesSize(out.Items)))
 	return nil
 }
 
 func (r *rpc) MExpire(in *kvV1.Request, _ *kvV1.Response) error {
+	return r.mexpire(context.Background(), in, nil)
+}
+
+func (r *rpc) mexpire(ctx context.Context, in *kvV1.Request, _ *kvV1.Response) error {
 	const op = errors.Op("rpc_mexpire")
 
-	ctx, span := r.tracer.Start(context.Background(), "kv:mexpire")
+	in, md, err := requestMetadata(in)
+	ctx, span := r.tracer.Start(requestContext(ctx, md), "kv:mexpire")
 	defer span.End()
 
-	st, err := r.lookupStorage(in.GetStorage())
 	if err != nil {
-		span.RecordError(err)
-		return err
+		recordError(span, err)
+		return rpcError(op, err)
 	}
 
-	if err := st.MExpire(ctx, from(in.GetItems())...); err != nil {
-		span.RecordError(err)
-		return errors.E(op, err)
+	ctx, cancel, err := withClientTimeout(ctx, md)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.GetStorage())
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+
+	entry.traceKeys(span, keysOf(in.GetItems()))
+
+	// the timeouts are checked before any storage call
+	items, err := entry.itemsFrom(in.GetItems())
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	start := time.Now()
+	err = boundedErr(ctx, entry, opWrite, func(ctx context.Context) error {
+		return entry.MExpire(ctx, items...)
+	})
+	r.metrics.observe(in.GetStorage(), "mexpire", start, len(in.GetItems()), err)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
 	}
 	return nil
 }
 
 func (r *rpc) TTL(in *kvV1.Request, out *kvV1.Response) error {
+	return r.ttl(context.Background(), in, out)
+}
+
+func (r *rpc) ttl(ctx context.Context, in *kvV1.Request, out *kvV1.Response) error {
 	const op = errors.Op("rpc_ttl")
 
-	ctx, span := r.tracer.Start(context.Background(), "kv:ttl")
+	in, md, err := requestMetadata(in)
+	ctx, span := r.tracer.Start(requestContext(ctx, md), "kv:ttl")
 	defer span.End()
 
-	st, err := r.lookupStorage(in.GetStorage())
 	if err != nil {
-		span.RecordError(err)
-		return err
+		recordError(span, err)
+		return rpcError(op, err)
 	}
 
-	keys := keysOf(in.GetItems())
+	ctx, cancel, err := withClientTimeout(ctx, md)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.GetStorage())
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
 
-	ret, err := st.TTL(ctx, keys...)
+	keys := keysOf(in.GetItems())
+	entry.traceKeys(span, keys)
+	// the extensions queued by the previous reads are reported right away
+	entry.flushSliding(ctx)
+
+	start := time.Now()
+	ret, err := bounded(ctx, entry, opRead, func(ctx context.Context) (map[string]string, error) {
+		return entry.TTL(ctx, keys...)
+	})
+	r.metrics.observe(in.GetStorage(), "ttl", start, len(keys), err)
 	if err != nil {
-		span.RecordError(err)
-		return errors.E(op, err)
+		entry.recordError(span, err)
+		return rpcError(op, err)
 	}
 
 	out.Items = make([]*kvV1.Item, 0, len(ret))
@@ -162,53 +389,95 @@ func (r *rpc) TTL(in *kvV1.Request, out *kvV1.Response) error {
 }
 
 func (r *rpc) Delete(in *kvV1.Request, _ *kvV1.Response) error {
+	return r.del(context.Background(), in, nil)
+}
+
+func (r *rpc) del(ctx context.Context, in *kvV1.Request, _ *kvV1.Response) error {
 	const op = errors.Op("rpc_delete")
 
-	ctx, span := r.tracer.Start(context.Background(), "kv:delete")
+	in, md, err := requestMetadata(in)
+	ctx, span := r.tracer.Start(requestContext(ctx, md), "kv:delete")
 	defer span.End()
 
-	st, err := r.lookupStorage(in.GetStorage())
 	if err != nil {
-		span.RecordError(err)
-		return err
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	ctx, cancel, err := withClientTimeout(ctx, md)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.GetStorage())
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
 	}
+	defer entry.release()
 
 	keys := keysOf(in.GetItems())
+	entry.traceKeys(span, keys)
 
-	if err := st.Delete(ctx, keys...); err != nil {
-		span.RecordError(err)
-		return errors.E(op, err)
+	start := time.Now()
+	err = boundedErr(ctx, entry, opWrite, func(ctx context.Context) error {
+		return entry.Delete(ctx, keys...)
+	})
+	r.metrics.observe(in.GetStorage(), "delete", start, len(keys), err)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
 	}
 	return nil
 }
 
 func (r *rpc) Clear(in *kvV1.Request, _ *kvV1.Response) error {
+	return r.clear(context.Background(), in, nil)
+}
+
+func (r *rpc) clear(ctx context.Context, in *kvV1.Request, _ *kvV1.Response) error {
 	const op = errors.Op("rpc_clear")
 
-	ctx, span := r.tracer.Start(context.Background(), "kv:clear")
+	in, md, err := requestMetadata(in)
+	ctx, span := r.tracer.Start(requestContext(ctx, md), "kv:clear")
 	defer span.End()
 
-	st, err := r.lookupStorage(in.GetStorage())
 	if err != nil {
-		span.RecordError(err)
-		return err
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	ctx, cancel, err := withClientTimeout(ctx, md)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.GetStorage())
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
 	}
+	defer entry.release()
 
-	if err := st.Clear(ctx); err != nil {
-		span.RecordError(err)
-		return errors.E(op, err)
+	start := time.Now()
+	err = boundedErr(ctx, entry, opClear, entry.Clear)
+	r.metrics.observe(in.GetStorage(), "clear", start, 0, err)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
 	}
 	return nil
 }
 
-func from(tr []*kvV1.Item) []kv.Item {
-	items := make([]kv.Item, 0, len(tr))
-	for i := range tr {
-		items = append(items, &Item{
-			key:     tr[i].GetKey(),
-			val:     tr[i].GetValue(),
-			timeout: tr[i].GetTimeout(),
-		})
+// valuesSize returns the total size of the item values.
+func valuesSize(items []*kvV1.Item) int {
+	n := 0
+	for _, it := range items {
+		n += len(it.GetValue())
 	}
-	return items
+	return n
 }
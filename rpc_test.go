@@ -16,7 +16,7 @@ const (
 	servedStorage = "south"
 	firstKey      = "alpha"
 	secondKey     = "beta"
-	rfc3339Expiry = "2026-01-01T00:00:00Z"
+	rfc3339Expiry = "2036-01-01T00:00:00Z"
 )
 
 // rpcMethod is one entry of the goridge surface: the adapter method, the span it
@@ -45,8 +45,15 @@ func rpcMethods() []rpcMethod {
 func newRPC(t *testing.T, st kv.Storage) (*rpc, *tracetest.SpanRecorder) {
 	t.Helper()
 
+	return newRPCWithSection(t, st, map[string]any{"driver": "fake"})
+}
+
+// newRPCWithSection is newRPC declaring the storage with the given kv section.
+func newRPCWithSection(t *testing.T, st kv.Storage, section map[string]any) (*rpc, *tracetest.SpanRecorder) {
+	t.Helper()
+
 	p, _ := newInitedPlugin(t,
-		map[string]any{servedStorage: map[string]any{"driver": "fake"}},
+		map[string]any{servedStorage: section},
 		map[string]bool{servedStorage: true},
 	)
 
@@ -219,3 +226,127 @@ func TestRPCDriverErrorsRecordSpans(t *testing.T) {
 		})
 	}
 }
+
+func TestRPCGet(t *testing.T) {
+	st := &fakeStorage{getRet: map[string][]byte{firstKey: []byte("a"), secondKey: {}}}
+	r, rec := newRPC(t, st)
+
+	get := func(key string) (*kvV1.Response, error) {
+		var out kvV1.Response
+		err := r.Get(&kvV1.Request{Storage: servedStorage, Items: []*kvV1.Item{{Key: key}}}, &out)
+
+		return &out, err
+	}
+
+	out, err := get(firstKey)
+	require.NoError(t, err)
+	require.Len(t, out.GetItems(), 1)
+	assert.Equal(t, firstKey, out.GetItems()[0].GetKey())
+	assert.Equal(t, []byte("a"), out.GetItems()[0].GetValue())
+
+	// an empty value is still a hit
+	out, err = get(secondKey)
+	require.NoError(t, err)
+	require.Len(t, out.GetItems(), 1)
+	assert.Empty(t, out.GetItems()[0].GetValue())
+
+	out, err = get("gamma")
+	require.NoError(t, err)
+	assert.Empty(t, out.GetItems())
+
+	assert.Equal(t, []string{firstKey, secondKey, "gamma"}, st.recorded().getKeys)
+
+	ended := rec.Ended()
+	require.Len(t, ended, 3)
+	for _, s := range ended {
+		assert.Equal(t, "kv:get", s.Name())
+	}
+}
+
+func TestRPCGetErrors(t *testing.T) {
+	st := &fakeStorage{}
+	r, _ := newRPC(t, st)
+
+	var out kvV1.Response
+	require.ErrorIs(t, r.Get(&kvV1.Request{Items: twoItems()[:1]}, &out), errEmptyStorage)
+	require.ErrorIs(t, r.Get(&kvV1.Request{Storage: "ghost", Items: twoItems()[:1]}, &out), errNoSuchStore)
+
+	err := r.Get(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &out)
+	assert.ErrorContains(t, err, errSingleKey.Error())
+	assert.ErrorContains(t, err, "rpc_get")
+	assert.Empty(t, st.recorded().getKeys)
+
+	r, rec := newRPC(t, &fakeStorage{err: stderr.New("driver is unhappy")})
+	err = r.Get(&kvV1.Request{Storage: servedStorage, Items: twoItems()[:1]}, &out)
+	assert.ErrorContains(t, err, "driver is unhappy")
+	assert.ErrorContains(t, err, "rpc_get")
+	assert.Empty(t, out.GetItems())
+
+	ended := rec.Ended()
+	require.Len(t, ended, 1)
+	require.Len(t, ended[0].Events(), 1)
+	assert.Equal(t, "exception", ended[0].Events()[0].Name)
+}
+
+func TestRPCMetadataItems(t *testing.T) {
+	st := &fakeStorage{mgetRet: map[string][]byte{firstKey: []byte("a")}}
+	r, rec := newRPC(t, st)
+
+	withTrace := func(items ...*kvV1.Item) []*kvV1.Item {
+		return append([]*kvV1.Item{
+			{Key: metadataPrefix + "traceparent", Value: []byte(traceparent)},
+			{Key: metadataPrefix + "tracestate", Value: []byte("rr=kv")},
+		}, items...)
+	}
+
+	require.NoError(t, r.Set(&kvV1.Request{Storage: servedStorage, Items: withTrace(twoItems()...)}, &kvV1.Response{}))
+
+	var out kvV1.Response
+	require.NoError(t, r.MGet(&kvV1.Request{Storage: servedStorage, Items: withTrace(&kvV1.Item{Key: firstKey})}, &out))
+	assert.Equal(t, []string{firstKey}, responseKeys(&out))
+
+	// the metadata items never reach the storage
+	calls := st.recorded()
+	assert.Equal(t, []itemSnapshot{
+		{key: firstKey, value: []byte("a"), timeout: rfc3339Expiry},
+		{key: secondKey, value: []byte("b")},
+	}, calls.setItems)
+	assert.Equal(t, []string{firstKey}, calls.mgetKeys)
+
+	ended := rec.Ended()
+	require.Len(t, ended, 2)
+	for i, want := range []struct {
+		name string
+		keys int64
+	}{{name: "kv:set", keys: 2}, {name: "kv:mget", keys: 1}} {
+		span := ended[i]
+		assert.Equal(t, want.name, span.Name())
+		assert.Equal(t, callerTraceID, span.SpanContext().TraceID().String())
+		assert.Equal(t, callerSpanID, span.Parent().SpanID().String())
+		assert.True(t, span.Parent().IsRemote())
+		assert.Equal(t, "rr=kv", span.SpanContext().TraceState().String())
+		// the span counts the keys only
+		assert.Equal(t, want.keys, spanAttrs(span)[attrKeyCount].AsInt64())
+	}
+}
+
+func TestRPCReservedKeys(t *testing.T) {
+	st := &fakeStorage{}
+	r, _ := newRPC(t, st)
+
+	// a key using the metadata prefix is not dropped silently
+	err := r.Set(&kvV1.Request{Storage: servedStorage, Items: []*kvV1.Item{
+		{Key: firstKey, Value: []byte("a")},
+		{Key: metadataPrefix + "user", Value: []byte("b")},
+	}}, &kvV1.Response{})
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	assert.Equal(t, CodeInvalidArgument, codeOf(err))
+	assert.Empty(t, st.recorded().setItems)
+
+	// the metadata keys are matched case-insensitively
+	require.NoError(t, r.Set(&kvV1.Request{Storage: servedStorage, Items: []*kvV1.Item{
+		{Key: firstKey, Value: []byte("a")},
+		{Key: metadataPrefix + "Timeout", Value: []byte("1s")},
+	}}, &kvV1.Response{}))
+	assert.Len(t, st.recorded().setItems, 1)
+}
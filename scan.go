@@ -0,0 +1,275 @@
+package kv
+
+import (
+	"context"
+	stderr "errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/roadrunner-server/errors"
+)
+
+const (
+	// scanDefaultCount is the page size used when the request doesn't set one
+	scanDefaultCount int = 100
+	// scanMaxCount caps the page size a client may ask for
+	scanMaxCount int = 1000
+)
+
+// Scanner is an optional capability of the kv.Storage. Drivers implementing it
+// can enumerate the keys they hold.
+type Scanner interface {
+	// Scan returns up to count keys matching the glob pattern (see MatchKey for
+	// the syntax, the one of the redis SCAN MATCH), starting at the opaque cursor
+	// ("" for the first page), and the cursor of the next page. An empty next
+	// cursor means that the scan is complete.
+	Scan(ctx context.Context, pattern, cursor string, count int) ([]string, string, error)
+}
+
+var errBadPattern = stderr.New("syntax error in pattern")
+
+// ScanRequest is the payload of the kv.Scan RPC call.
+type ScanRequest struct {
+	Storage string `json:"storage"`
+	// Prefix limits the scan to the keys starting with it
+	Prefix string `json:"prefix,omitempty"`
+	// Match is a glob applied after the prefix, for example user:*:session. The *
+	// matches any characters, "/" and ":" included, see MatchKey
+	Match string `json:"match,omitempty"`
+	// Count is the page size, 100 by default
+	Count int `json:"count,omitempty"`
+	// Cursor is the value returned by the previous page, empty for the first one
+	Cursor   string   `json:"cursor,omitempty"`
+	Metadata Metadata `json:"metadata,omitempty"`
+}
+
+// ScanResponse holds a single page of keys.
+type ScanResponse struct {
+	Keys []string `json:"keys"`
+	// Cursor should be passed to the next call, empty when there are no more keys
+	Cursor string `json:"cursor"`
+}
+
+// Scan returns a page of the keys matching the requested prefix and glob.
+func (r *rpc) Scan(in *ScanRequest, out *ScanResponse) error {
+	const op = errors.Op("rpc_scan")
+
+	ctx, span := r.tracer.Start(contextFrom(in.Metadata), "kv:scan")
+	defer span.End()
+
+	ctx, cancel, err := withClientTimeout(ctx, in.Metadata)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+	defer cancel()
+
+	entry, err := r.lookupStorage(ctx, in.Storage)
+	if err != nil {
+		recordError(span, err)
+		return withCode(err)
+	}
+	defer entry.release()
+	st := entry.Storage
+
+	sc, ok := st.(Scanner)
+	if !ok {
+		err = fmt.Errorf("%w: scan, storage: %s", ErrUnsupported, in.Storage)
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	pattern, err := scanPattern(in.Prefix, in.Match)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	count := in.Count
+	switch {
+	case count <= 0:
+		count = scanDefaultCount
+	case count > scanMaxCount:
+		count = scanMaxCount
+	}
+
+	start := time.Now()
+	page, err := bounded(ctx, entry, opRead, func(ctx context.Context) (ScanResponse, error) {
+		keys, cursor, err := sc.Scan(ctx, pattern, in.Cursor, count)
+		return ScanResponse{Keys: keys, Cursor: cursor}, err
+	})
+	keys, cursor := page.Keys, page.Cursor
+	r.metrics.observe(in.Storage, "scan", start, len(keys), err)
+	if err != nil {
+		entry.recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	span.SetAttributes(attrKeyCount.Int(len(keys)))
+	out.Keys = keys
+	out.Cursor = cursor
+	return nil
+}
+
+// scanPattern merges the prefix and the glob into a single pattern. The prefix is
+// matched literally, so its glob metacharacters are escaped.
+func scanPattern(prefix, match string) (string, error) {
+	if match == "" {
+		match = "*"
+	}
+
+	var sb strings.Builder
+	for _, c := range prefix {
+		switch c {
+		case '*', '?', '[', '\\':
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(c)
+	}
+	sb.WriteString(match)
+
+	pattern := sb.String()
+	if _, err := MatchKey(pattern, ""); err != nil {
+		return "", fmt.Errorf("%w: %s", err, match)
+	}
+
+	return pattern, nil
+}
+
+// MatchKey reports whether the key matches the scan pattern. The syntax is the
+// one of the redis SCAN MATCH: unlike in path.Match, a * matches any sequence of
+// characters, "/" included, ? matches a single character, [abc], [a-z] and [^a]
+// are the character classes and a backslash escapes the next character. A
+// malformed pattern, with an unterminated or empty class or a trailing
+// backslash, fails regardless of the key.
+func MatchKey(pattern, key string) (bool, error) {
+	// validated upfront, so the result doesn't depend on how far the key got
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			if i++; i == len(pattern) {
+				return false, errBadPattern
+			}
+		case '[':
+			_, end, err := matchClass(pattern, i, -1)
+			if err != nil {
+				return false, err
+			}
+			i = end - 1
+		}
+	}
+
+	return matchGlob(pattern, key), nil
+}
+
+// matchGlob matches the validated pattern, backtracking to the last * on a
+// mismatch.
+func matchGlob(pattern, key string) bool {
+	px, kx := 0, 0
+	starPx, starKx := -1, 0
+
+	for px < len(pattern) || kx < len(key) {
+		if px < len(pattern) {
+			switch c := pattern[px]; c {
+			case '*':
+				starPx, starKx = px, kx
+				px++
+				continue
+			case '?':
+				if kx < len(key) {
+					_, w := utf8.DecodeRuneInString(key[kx:])
+					px++
+					kx += w
+					continue
+				}
+			case '[':
+				if kx < len(key) {
+					r, w := utf8.DecodeRuneInString(key[kx:])
+					if ok, end, _ := matchClass(pattern, px, r); ok {
+						px = end
+						kx += w
+						continue
+					}
+				}
+			default:
+				lit := px
+				if c == '\\' {
+					lit++
+				}
+				pr, pw := utf8.DecodeRuneInString(pattern[lit:])
+				if kx < len(key) {
+					if r, w := utf8.DecodeRuneInString(key[kx:]); r == pr {
+						px = lit + pw
+						kx += w
+						continue
+					}
+				}
+			}
+		}
+
+		// let the last * take one more character
+		if starPx < 0 || starKx == len(key) {
+			return false
+		}
+		_, w := utf8.DecodeRuneInString(key[starKx:])
+		starKx += w
+		px, kx = starPx+1, starKx
+	}
+
+	return true
+}
+
+// matchClass matches the rune against the class starting at the [ at pattern[start]
+// and returns the index past its closing ].
+func matchClass(pattern string, start int, r rune) (bool, int, error) {
+	i := start + 1
+	negate := i < len(pattern) && (pattern[i] == '^' || pattern[i] == '!')
+	if negate {
+		i++
+	}
+
+	// classRune reads a possibly escaped character of the class
+	classRune := func() (rune, error) {
+		if i < len(pattern) && pattern[i] == '\\' {
+			i++
+		}
+		if i >= len(pattern) {
+			return 0, errBadPattern
+		}
+		c, w := utf8.DecodeRuneInString(pattern[i:])
+		i += w
+		return c, nil
+	}
+
+	matched, empty := false, true
+	for i < len(pattern) && pattern[i] != ']' {
+		lo, err := classRune()
+		if err != nil {
+			return false, 0, err
+		}
+
+		hi := lo
+		if i < len(pattern) && pattern[i] == '-' {
+			i++
+			if i < len(pattern) && pattern[i] == ']' {
+				return false, 0, errBadPattern
+			}
+			if hi, err = classRune(); err != nil {
+				return false, 0, err
+			}
+		}
+
+		if lo <= r && r <= hi {
+			matched = true
+		}
+		empty = false
+	}
+
+	if i >= len(pattern) || empty {
+		return false, 0, errBadPattern
+	}
+
+	return matched != negate, i + 1, nil
+}
@@ -0,0 +1,123 @@
+package kv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scanStorage is a fakeStorage with the Scanner capability. It records the
+// arguments of the last Scan call and answers with the canned page.
+type scanStorage struct {
+	fakeStorage
+
+	pattern string
+	cursor  string
+	count   int
+
+	keys []string
+	next string
+}
+
+func (s *scanStorage) Scan(_ context.Context, pattern, cursor string, count int) ([]string, string, error) {
+	s.pattern, s.cursor, s.count = pattern, cursor, count
+
+	return s.keys, s.next, s.err
+}
+
+func TestScanPattern(t *testing.T) {
+	cases := []struct {
+		prefix, match, want string
+	}{
+		{want: "*"},
+		{prefix: "user:", want: "user:*"},
+		{match: "*:session", want: "*:session"},
+		{prefix: "user:", match: "*:session", want: "user:*:session"},
+		{prefix: "a*b?[c]\\", want: "a\\*b\\?\\[c]\\\\*"},
+	}
+
+	for _, tc := range cases {
+		got, err := scanPattern(tc.prefix, tc.match)
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, got)
+	}
+
+	_, err := scanPattern("", "[")
+	require.Error(t, err)
+}
+
+func TestMatchKey(t *testing.T) {
+	cases := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{pattern: "*", key: "user/1/session", want: true},
+		{pattern: "*", key: "", want: true},
+		{pattern: "user:*", key: "user:1:session", want: true},
+		{pattern: "user/*/session", key: "user/1/2/session", want: true},
+		{pattern: "user/*/session", key: "user/1/profile"},
+		{pattern: "*:session", key: "a:b:session", want: true},
+		{pattern: "*a*b", key: "xaybzab", want: true},
+		{pattern: "*a*b", key: "xaybza"},
+		{pattern: "h?llo", key: "héllo", want: true},
+		{pattern: "h?llo", key: "hllo"},
+		{pattern: "h[ae]llo", key: "hallo", want: true},
+		{pattern: "h[^e]llo", key: "hello"},
+		{pattern: "h[!e]llo", key: "hallo", want: true},
+		{pattern: "h[a-c]llo", key: "hbllo", want: true},
+		{pattern: "h[a-c]llo", key: "hdllo"},
+		{pattern: "a\\*b", key: "a*b", want: true},
+		{pattern: "a\\*b", key: "axb"},
+		{pattern: "[\\]]", key: "]", want: true},
+	}
+
+	for _, tc := range cases {
+		got, err := MatchKey(tc.pattern, tc.key)
+		require.NoError(t, err, tc.pattern)
+		assert.Equal(t, tc.want, got, "%s ~ %s", tc.pattern, tc.key)
+	}
+
+	for _, pattern := range []string{"[", "[]", "a\\", "[a-]", "[a", "*[^"} {
+		_, err := MatchKey(pattern, "a")
+		assert.ErrorIs(t, err, errBadPattern, pattern)
+	}
+}
+
+func TestRPCScan(t *testing.T) {
+	st := &scanStorage{keys: []string{firstKey, secondKey}, next: "42"}
+	r, rec := newRPC(t, st)
+
+	var out ScanResponse
+	require.NoError(t, r.Scan(&ScanRequest{Storage: servedStorage, Prefix: "a", Cursor: "7"}, &out))
+	assert.Equal(t, []string{firstKey, secondKey}, out.Keys)
+	assert.Equal(t, "42", out.Cursor)
+	assert.Equal(t, "a*", st.pattern)
+	assert.Equal(t, "7", st.cursor)
+	assert.Equal(t, scanDefaultCount, st.count)
+
+	require.NoError(t, r.Scan(&ScanRequest{Storage: servedStorage, Count: scanMaxCount + 1}, &out))
+	assert.Equal(t, scanMaxCount, st.count)
+
+	ended := rec.Ended()
+	require.Len(t, ended, 2)
+	assert.Equal(t, "kv:scan", ended[0].Name())
+}
+
+func TestRPCScanErrors(t *testing.T) {
+	r, _ := newRPC(t, &fakeStorage{})
+
+	var out ScanResponse
+	require.ErrorIs(t, r.Scan(&ScanRequest{}, &out), errEmptyStorage)
+	require.ErrorIs(t, r.Scan(&ScanRequest{Storage: "ghost"}, &out), errNoSuchStore)
+
+	err := r.Scan(&ScanRequest{Storage: servedStorage}, &out)
+	assert.ErrorContains(t, err, ErrUnsupported.Error())
+	assert.ErrorContains(t, err, "rpc_scan")
+
+	st := &scanStorage{}
+	r, _ = newRPC(t, st)
+	assert.ErrorContains(t, r.Scan(&ScanRequest{Storage: servedStorage, Match: "["}, &out), "syntax error in pattern")
+	assert.Empty(t, st.pattern)
+}
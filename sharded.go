@@ -0,0 +1,339 @@
+package kv
+
+import (
+	"context"
+	stderr "errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/roadrunner-server/errors"
+)
+
+const (
+	// shardedDriver is the driver name of the consistent hashing composite
+	shardedDriver string = "sharded"
+
+	// keys of the sharded section
+	shardedShards string = "shards"
+	shardedVNodes string = "vnodes"
+	// keys of a shard declared as a map
+	shardStorage string = "storage"
+	shardWeight  string = "weight"
+
+	// defaultVNodes is the number of the ring points per unit of weight
+	defaultVNodes int = 160
+	// maxVNodes caps the number of the ring points per unit of weight
+	maxVNodes int = 10000
+	// maxRingPoints caps the size of the ring, the sum of the weights times vnodes
+	maxRingPoints int = 1 << 20
+)
+
+// shardedSpec is the section of a sharded storage. A shard is either a storage
+// name or a map with the storage name and its weight, 1 by default:
+//
+//	kv:
+//	  mc1:
+//	    driver: memcached
+//	    config:
+//	      addr: ["10.0.0.1:11211"]
+//	  mc2:
+//	    driver: memcached
+//	    config:
+//	      addr: ["10.0.0.2:11211"]
+//	  cache:
+//	    driver: sharded
+//	    vnodes: 160
+//	    shards:
+//	      - mc1
+//	      - storage: mc2
+//	        weight: 2
+type shardedSpec struct {
+	shards  []string
+	weights []int
+	// vnodes is the number of the ring points per unit of weight
+	vnodes int
+}
+
+func parseSharded(name string, section map[string]any) (compositeSpec, error) {
+	spec := &shardedSpec{vnodes: defaultVNodes}
+
+	list, _ := section[shardedShards].([]any)
+	if len(list) == 0 {
+		return nil, errors.Errorf("the %s storage should list its %s by the storage names", name, shardedShards)
+	}
+
+	for _, v := range list {
+		storage, weight := "", 1
+		switch s := v.(type) {
+		case string:
+			storage = s
+		case map[string]any:
+			storage, _ = s[shardStorage].(string)
+			if w, ok := s[shardWeight]; ok {
+				weight = positiveInt(w)
+			}
+		}
+
+		if storage == "" || slices.Contains(spec.shards, storage) {
+			return nil, errors.Errorf("wrong %s value in the %s storage: %v, should be the names of distinct storages", shardedShards, name, v)
+		}
+		if weight <= 0 {
+			return nil, errors.Errorf("wrong weight of the %s shard in the %s storage: %v, should be a positive integer", storage, name, v)
+		}
+
+		spec.shards = append(spec.shards, storage)
+		spec.weights = append(spec.weights, weight)
+	}
+
+	if v, ok := section[shardedVNodes]; ok {
+		spec.vnodes = positiveInt(v)
+		if spec.vnodes <= 0 || spec.vnodes > maxVNodes {
+			return nil, errors.Errorf("wrong %s value in the %s storage: %v, should be an integer from 1 to %d", shardedVNodes, name, v, maxVNodes)
+		}
+	}
+
+	points := 0
+	for i, w := range spec.weights {
+		// every weight is checked on its own first, so the sum can't overflow
+		if w > maxRingPoints/spec.vnodes || points+w*spec.vnodes > maxRingPoints {
+			return nil, errors.Errorf("wrong weight of the %s shard in the %s storage: %d, the weights times %s should not exceed %d", spec.shards[i], name, w, shardedVNodes, maxRingPoints)
+		}
+		points += w * spec.vnodes
+	}
+
+	return spec, nil
+}
+
+// positiveInt returns the integer the configuration value holds, 0 when it's not
+// a positive integer.
+func positiveInt(v any) int {
+	switch n := v.(type) {
+	case int:
+		return max(n, 0)
+	case float64:
+		if n > 0 && n == float64(int(n)) {
+			return int(n)
+		}
+	}
+
+	return 0
+}
+
+func (s *shardedSpec) refs() []string {
+	return s.shards
+}
+
+func (s *shardedSpec) build(_ *compositeEnv, tiers []kv.Storage) (kv.Storage, error) {
+	sh := &sharded{shards: make([]*shard, 0, len(tiers))}
+	for i, st := range tiers {
+		sh.shards = append(sh.shards, &shard{Storage: st, name: s.shards[i]})
+
+		// the points depend on the storage names only, so the keys of the
+		// remaining shards stay in place when a shard is added or removed
+		for v := range s.weights[i] * s.vnodes {
+			sh.ring = append(sh.ring, point{hash: ringHash(s.shards[i] + "#" + strconv.Itoa(v)), shard: i})
+		}
+	}
+
+	sort.Slice(sh.ring, func(a, b int) bool {
+		if sh.ring[a].hash == sh.ring[b].hash {
+			return sh.shards[sh.ring[a].shard].name < sh.shards[sh.ring[b].shard].name
+		}
+		return sh.ring[a].hash < sh.ring[b].hash
+	})
+
+	return sh, nil
+}
+
+// sharded spreads the keys over the shards with consistent hashing. Every shard
+// owns a number of points on the ring proportional to its weight, a key belongs
+// to the shard of the first point following the hash of the key. The multi-key
+// calls are split into per-shard batches executed in parallel, a call fails when
+// any of its batches fails.
+type sharded struct {
+	stopNothing
+
+	shards []*shard
+	ring   []point
+}
+
+// shard is a storage of the sharded composite.
+type shard struct {
+	kv.Storage
+	name string
+}
+
+// point is a virtual node of a shard on the ring.
+type point struct {
+	hash  uint64
+	shard int
+}
+
+// ringHash is the 64-bit FNV-1a of the string with the murmur3 finalizer, the
+// latter spreading the similar strings (the virtual node names) over the ring.
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return x
+}
+
+// route returns the shard owning the key.
+func (s *sharded) route(key string) *shard {
+	h := ringHash(key)
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+
+	return s.shards[s.ring[i].shard]
+}
+
+// split groups the batch by the shards owning the keys.
+func split[T any](s *sharded, batch []T, key func(T) string) map[*shard][]T {
+	ret := make(map[*shard][]T, len(s.shards))
+	for _, v := range batch {
+		sh := s.route(key(v))
+		ret[sh] = append(ret[sh], v)
+	}
+
+	return ret
+}
+
+// fanOut calls fn with every per-shard batch, in parallel, and returns the joined
+// errors of the failed batches.
+func fanOut[T any](batches map[*shard][]T, fn func(sh *shard, batch []T) error) error {
+	// a single batch doesn't need a goroutine
+	if len(batches) == 1 {
+		for sh, batch := range batches {
+			if err := fn(sh, batch); err != nil {
+				return fmt.Errorf("shard %s: %w", sh.name, err)
+			}
+		}
+		return nil
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for sh, batch := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(sh, batch); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("shard %s: %w", sh.name, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return stderr.Join(errs...)
+}
+
+func self(key string) string {
+	return key
+}
+
+func itemKey(it kv.Item) string {
+	return it.Key()
+}
+
+// collect runs the read with every shard's keys, in parallel, and merges the
+// answers.
+func collect[V any](s *sharded, keys []string, read func(sh *shard, batch []string) (map[string]V, error)) (map[string]V, error) {
+	var mu sync.Mutex
+	ret := make(map[string]V, len(keys))
+	err := fanOut(split(s, keys, self), func(sh *shard, batch []string) error {
+		res, err := read(sh, batch)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for k, v := range res {
+			ret[k] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// Has asks every shard about its keys.
+func (s *sharded) Has(ctx context.Context, keys ...string) (map[string]bool, error) {
+	return collect(s, keys, func(sh *shard, batch []string) (map[string]bool, error) {
+		return sh.Has(ctx, batch...)
+	})
+}
+
+// Get reads the key from its shard.
+func (s *sharded) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.route(key).Get(ctx, key)
+}
+
+// MGet reads the values of every shard's keys.
+func (s *sharded) MGet(ctx context.Context, keys ...string) (map[string][]byte, error) {
+	return collect(s, keys, func(sh *shard, batch []string) (map[string][]byte, error) {
+		return sh.MGet(ctx, batch...)
+	})
+}
+
+// TTL reads the expiration of every shard's keys.
+func (s *sharded) TTL(ctx context.Context, keys ...string) (map[string]string, error) {
+	return collect(s, keys, func(sh *shard, batch []string) (map[string]string, error) {
+		return sh.TTL(ctx, batch...)
+	})
+}
+
+// Set writes every shard's items.
+func (s *sharded) Set(ctx context.Context, items ...kv.Item) error {
+	return fanOut(split(s, items, itemKey), func(sh *shard, batch []kv.Item) error {
+		return sh.Set(ctx, batch...)
+	})
+}
+
+// MExpire changes the expiration of every shard's keys.
+func (s *sharded) MExpire(ctx context.Context, items ...kv.Item) error {
+	return fanOut(split(s, items, itemKey), func(sh *shard, batch []kv.Item) error {
+		return sh.MExpire(ctx, batch...)
+	})
+}
+
+// Delete removes every shard's keys.
+func (s *sharded) Delete(ctx context.Context, keys ...string) error {
+	return fanOut(split(s, keys, self), func(sh *shard, batch []string) error {
+		return sh.Delete(ctx, batch...)
+	})
+}
+
+// Clear cleans all the shards.
+func (s *sharded) Clear(ctx context.Context) error {
+	batches := make(map[*shard][]struct{}, len(s.shards))
+	for _, sh := range s.shards {
+		batches[sh] = nil
+	}
+
+	return fanOut(batches, func(sh *shard, _ []struct{}) error {
+		return sh.Clear(ctx)
+	})
+}
@@ -0,0 +1,168 @@
+package kv
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSharded builds a sharded storage over memStorages named after the shards.
+func newSharded(t *testing.T, section map[string]any) (*sharded, map[string]*memStorage) {
+	t.Helper()
+
+	spec, err := parseSharded("cache", section)
+	require.NoError(t, err)
+
+	shards := make(map[string]*memStorage)
+	tiers := make([]kv.Storage, 0)
+	for _, name := range spec.refs() {
+		shards[name] = newMemStorage()
+		tiers = append(tiers, shards[name])
+	}
+
+	st, err := spec.build(nil, tiers)
+	require.NoError(t, err)
+
+	return st.(*sharded), shards
+}
+
+func TestShardedWeights(t *testing.T) {
+	s, _ := newSharded(t, map[string]any{"shards": []any{
+		"a",
+		"b",
+		map[string]any{"storage": "c", "weight": 2},
+	}})
+
+	const keys = 20000
+	owned := make(map[string]int)
+	for i := range keys {
+		owned[s.route("key:"+strconv.Itoa(i)).name]++
+	}
+
+	assert.InDelta(t, keys/4, owned["a"], keys*0.03)
+	assert.InDelta(t, keys/4, owned["b"], keys*0.03)
+	assert.InDelta(t, keys/2, owned["c"], keys*0.03)
+}
+
+func TestShardedAddingShardMovesOnlyItsKeys(t *testing.T) {
+	before, _ := newSharded(t, map[string]any{"shards": []any{"a", "b"}})
+	after, _ := newSharded(t, map[string]any{"shards": []any{"c", "b", "a"}})
+
+	moved := 0
+	for i := range 10000 {
+		key := "key:" + strconv.Itoa(i)
+		from, to := before.route(key).name, after.route(key).name
+		if from != to {
+			// the keys move to the added shard only
+			require.Equal(t, "c", to, key)
+			moved++
+		}
+	}
+
+	assert.InDelta(t, 10000/3, moved, 10000*0.05)
+}
+
+func TestShardedSplitsBatches(t *testing.T) {
+	s, shards := newSharded(t, map[string]any{"shards": []any{"a", "b", "c"}, "vnodes": 64})
+	ctx := context.Background()
+
+	items := make([]kv.Item, 0, 30)
+	keys := make([]string, 0, 30)
+	for i := range 30 {
+		key := "key:" + strconv.Itoa(i)
+		keys = append(keys, key)
+		items = append(items, &Item{key: key, val: []byte(key)})
+	}
+	require.NoError(t, s.Set(ctx, items...))
+
+	// every key is stored by its shard only
+	for _, key := range keys {
+		for name, st := range shards {
+			_, ok := st.item(key)
+			assert.Equal(t, name == s.route(key).name, ok, key)
+		}
+	}
+
+	ret, err := s.MGet(ctx, append(keys, "missing")...)
+	require.NoError(t, err)
+	assert.Len(t, ret, 30)
+	for _, key := range keys {
+		assert.Equal(t, key, string(ret[key]))
+	}
+
+	has, err := s.Has(ctx, keys[0], "missing")
+	require.NoError(t, err)
+	assert.True(t, has[keys[0]])
+	assert.False(t, has["missing"])
+
+	require.NoError(t, s.Delete(ctx, keys...))
+	ret, err = s.MGet(ctx, keys...)
+	require.NoError(t, err)
+	assert.Empty(t, ret)
+}
+
+func TestShardedRPC(t *testing.T) {
+	a, b := newMemStorage(), &fakeStorage{err: assert.AnError}
+	r, _, _ := newCompositeRPC(t, map[string]any{
+		"a":     map[string]any{"driver": "mem"},
+		"b":     map[string]any{"driver": "failing"},
+		"cache": map[string]any{"driver": shardedDriver, "shards": []any{"a", "b"}},
+	}, map[string]kv.Storage{"mem": a, "failing": b})
+	st := r.pl.storages.snapshot()["cache"].Storage.(*sharded)
+
+	var onA, onB string
+	for i := 0; onA == "" || onB == ""; i++ {
+		key := "key:" + strconv.Itoa(i)
+		if st.route(key).name == "a" {
+			onA = key
+		} else {
+			onB = key
+		}
+	}
+
+	// the keys of the healthy shard work on their own
+	require.NoError(t, r.Set(&kvV1.Request{Storage: "cache", Items: []*kvV1.Item{{Key: onA, Value: []byte("v")}}}, &kvV1.Response{}))
+	var out kvV1.Response
+	require.NoError(t, r.MGet(&kvV1.Request{Storage: "cache", Items: []*kvV1.Item{{Key: onA}}}, &out))
+	assert.Len(t, out.GetItems(), 1)
+
+	// a failed batch fails the call
+	err := r.MGet(&kvV1.Request{Storage: "cache", Items: []*kvV1.Item{{Key: onA}, {Key: onB}}}, &out)
+	assert.ErrorContains(t, err, "shard b")
+}
+
+func TestParseSharded(t *testing.T) {
+	cases := []struct {
+		name    string
+		section map[string]any
+		err     string
+	}{
+		{name: "no shards", section: map[string]any{}, err: "should list its shards"},
+		{name: "duplicated shard", section: map[string]any{"shards": []any{"a", map[string]any{"storage": "a"}}}, err: "wrong shards value"},
+		{name: "shard without storage", section: map[string]any{"shards": []any{map[string]any{"weight": 2}}}, err: "wrong shards value"},
+		{name: "zero weight", section: map[string]any{"shards": []any{map[string]any{"storage": "a", "weight": 0}}}, err: "wrong weight of the a shard"},
+		{name: "fractional weight", section: map[string]any{"shards": []any{map[string]any{"storage": "a", "weight": 1.5}}}, err: "wrong weight of the a shard"},
+		{name: "too many vnodes", section: map[string]any{"shards": []any{"a"}, "vnodes": 100000}, err: "wrong vnodes value"},
+		{name: "huge weight", section: map[string]any{"shards": []any{map[string]any{"storage": "a", "weight": float64(1 << 62)}}}, err: "wrong weight of the a shard"},
+		{
+			name: "too large ring",
+			section: map[string]any{
+				"shards": []any{map[string]any{"storage": "a", "weight": 100}, map[string]any{"storage": "b", "weight": 100}},
+				"vnodes": 10000,
+			},
+			err: "wrong weight of the b shard",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseSharded("cache", tc.section)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
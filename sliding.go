@@ -0,0 +1,210 @@
+package kv
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+)
+
+const (
+	// slideInterval is how long the hit keys are collected before their expiry is extended
+	slideInterval = 100 * time.Millisecond
+	// slideBatch flushes the collected keys early once there are that many of them
+	slideBatch int = 256
+	// slideQueue is the number of hit keys waiting for the batcher, the keys read
+	// while it's full are not extended
+	slideQueue int = 4096
+)
+
+// slider extends the expiry of the keys read from a storage with the sliding_ttl
+// option. The reads only queue the hit keys, the batcher extends them in the
+// background with a single TTL and a single Touch (or MExpire) call per batch.
+// Only the expiring keys are extended, the persistent keys and the keys expiring
+// later than the sliding TTL are left as is.
+type slider struct {
+	st      kv.Storage
+	storage string
+	ttl     time.Duration
+	// timeout bounds the storage calls of a batch, 0 - unbounded
+	timeout time.Duration
+	log     *slog.Logger
+	metrics *metrics
+
+	keys    chan string
+	flushes chan chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newSlider(e *storageEntry, log *slog.Logger, m *metrics) *slider {
+	s := &slider{
+		st:      e.Storage,
+		storage: e.info.Name,
+		ttl:     e.opts.slidingTTL,
+		timeout: e.opts.writeTimeout,
+		log:     log,
+		metrics: m,
+		keys:    make(chan string, slideQueue),
+		flushes: make(chan chan struct{}),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go s.run()
+	return s
+}
+
+// slide queues the keys for the extension without blocking the caller.
+func (s *slider) slide(keys ...string) {
+	for _, k := range keys {
+		select {
+		case s.keys <- k:
+		default:
+			s.log.Debug("sliding ttl queue is full, skipping the key", "storage", s.storage)
+			return
+		}
+	}
+}
+
+// flush extends the queued keys and waits until it's done or the ctx is done.
+func (s *slider) flush(ctx context.Context) {
+	done := make(chan struct{})
+	select {
+	case s.flushes <- done:
+	case <-s.stopped:
+		return
+	case <-ctx.Done():
+		return
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// stop extends the queued keys and stops the batcher.
+func (s *slider) stop() {
+	close(s.done)
+	<-s.stopped
+}
+
+func (s *slider) run() {
+	ticker := time.NewTicker(slideInterval)
+	defer ticker.Stop()
+
+	pending := make(map[string]struct{}, slideBatch)
+	for {
+		select {
+		case k := <-s.keys:
+			pending[k] = struct{}{}
+			if len(pending) >= slideBatch {
+				s.extend(pending)
+			}
+		case <-ticker.C:
+			s.extend(pending)
+		case done := <-s.flushes:
+			s.drain(pending)
+			s.extend(pending)
+			close(done)
+		case <-s.done:
+			s.drain(pending)
+			s.extend(pending)
+			close(s.stopped)
+			return
+		}
+	}
+}
+
+// drain moves the queued keys to the pending ones.
+func (s *slider) drain(pending map[string]struct{}) {
+	for {
+		select {
+		case k := <-s.keys:
+			pending[k] = struct{}{}
+		default:
+			return
+		}
+	}
+}
+
+// extend moves the expiry of the pending expiring keys to now+ttl and empties the
+// pending set.
+func (s *slider) extend(pending map[string]struct{}) {
+	if len(pending) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(pending))
+	for k := range pending {
+		keys = append(keys, k)
+	}
+	clear(pending)
+
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	n, err := s.apply(ctx, keys, start)
+	s.metrics.observe(s.storage, "slide", start, n, err)
+	if err != nil {
+		s.log.Warn("failed to extend the sliding ttl", "storage", s.storage, "keys", len(keys), "error", err)
+	}
+}
+
+func (s *slider) apply(ctx context.Context, keys []string, now time.Time) (int, error) {
+	at := now.Add(s.ttl)
+
+	current, err := s.st.TTL(ctx, keys...)
+	if err != nil {
+		return 0, err
+	}
+
+	expiring := make([]string, 0, len(keys))
+	for _, k := range keys {
+		exp, err := time.Parse(time.RFC3339, current[k])
+		// missing, persistent or expiring later
+		if err != nil || !exp.Before(at) {
+			continue
+		}
+		expiring = append(expiring, k)
+	}
+
+	if len(expiring) == 0 {
+		return 0, nil
+	}
+
+	timeout := formatTimeout(at)
+	if ex, ok := s.st.(Expirer); ok {
+		_, err = ex.Touch(ctx, timeout, expiring...)
+		return len(expiring), err
+	}
+
+	items := make([]kv.Item, 0, len(expiring))
+	for _, k := range expiring {
+		items = append(items, &Item{key: k, timeout: timeout})
+	}
+
+	return len(expiring), s.st.MExpire(ctx, items...)
+}
+
+// slide queues the hit keys for the sliding TTL extension, if the storage has one.
+func (e *storageEntry) slide(keys ...string) {
+	if e.slider != nil {
+		e.slider.slide(keys...)
+	}
+}
+
+// flushSliding applies the queued sliding TTL extensions, so that the following
+// TTL call reports them.
+func (e *storageEntry) flushSliding(ctx context.Context) {
+	if e.slider != nil {
+		e.slider.flush(ctx)
+	}
+}
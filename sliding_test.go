@@ -0,0 +1,77 @@
+package kv
+
+import (
+	"testing"
+	"time"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRPCSlidingTTLExtendsReadKeys(t *testing.T) {
+	const laterKey = "gamma"
+
+	st := newMemStorage()
+	st.put(firstKey, "a", formatTimeout(time.Now().Add(time.Minute)))
+	st.put(secondKey, "b", "")
+	st.put(laterKey, "c", formatTimeout(time.Now().Add(24*time.Hour)))
+	r, _ := newRPCWithSection(t, st, map[string]any{"driver": "fake", "sliding_ttl": "1h"})
+
+	require.NoError(t, r.MGet(&kvV1.Request{Storage: servedStorage, Items: []*kvV1.Item{
+		{Key: firstKey}, {Key: secondKey}, {Key: laterKey}, {Key: "missing"},
+	}}, &kvV1.Response{}))
+
+	// TTL reports the extensions queued by the reads
+	var out TTLResponse
+	require.NoError(t, r.TTLDetailed(&KeysRequest{Storage: servedStorage, Keys: []string{firstKey, secondKey, laterKey, "missing"}}, &out))
+	require.Len(t, out.Items, 4)
+
+	at, err := time.Parse(time.RFC3339, out.Items[0].ExpiresAt)
+	require.NoError(t, err)
+	assert.InDelta(t, time.Hour.Seconds(), time.Until(at).Seconds(), 60)
+
+	// persistent keys, keys expiring later and missing keys are left as is
+	assert.Equal(t, TTLPersistent, out.Items[1].State)
+	later, _ := st.item(laterKey)
+	assert.Equal(t, later.timeout, out.Items[2].ExpiresAt)
+	assert.Equal(t, TTLMissing, out.Items[3].State)
+}
+
+func TestRPCSlidingTTLIsAsynchronous(t *testing.T) {
+	st := newMemStorage()
+	expiry := formatTimeout(time.Now().Add(time.Minute))
+	st.put(firstKey, "a", expiry)
+	r, _ := newRPCWithSection(t, st, map[string]any{"driver": "fake", "sliding_ttl": "1h"})
+
+	var out kvV1.Response
+	require.NoError(t, r.Get(&kvV1.Request{Storage: servedStorage, Items: []*kvV1.Item{{Key: firstKey}}}, &out))
+	require.Len(t, out.GetItems(), 1)
+
+	// the batcher extends the key in the background
+	assert.Eventually(t, func() bool {
+		it, _ := st.item(firstKey)
+		return it.timeout != expiry
+	}, time.Second, 10*time.Millisecond)
+
+	var ttl kvV1.Response
+	require.NoError(t, r.TTL(&kvV1.Request{Storage: servedStorage, Items: []*kvV1.Item{{Key: firstKey}}}, &ttl))
+	require.Len(t, ttl.GetItems(), 1)
+	at, err := time.Parse(time.RFC3339, ttl.GetItems()[0].GetTimeout())
+	require.NoError(t, err)
+	assert.InDelta(t, time.Hour.Seconds(), time.Until(at).Seconds(), 60)
+}
+
+func TestRPCWithoutSlidingTTLKeepsExpiry(t *testing.T) {
+	st := newMemStorage()
+	expiry := formatTimeout(time.Now().Add(time.Minute))
+	st.put(firstKey, "a", expiry)
+	r, _ := newRPCWithSection(t, st, map[string]any{"driver": "fake"})
+
+	require.NoError(t, r.Get(&kvV1.Request{Storage: servedStorage, Items: []*kvV1.Item{{Key: firstKey}}}, &kvV1.Response{}))
+
+	var ttl kvV1.Response
+	require.NoError(t, r.TTL(&kvV1.Request{Storage: servedStorage, Items: []*kvV1.Item{{Key: firstKey}}}, &ttl))
+	require.Len(t, ttl.GetItems(), 1)
+	assert.Equal(t, expiry, ttl.GetItems()[0].GetTimeout())
+}
@@ -0,0 +1,152 @@
+package kv
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// StorageInfo describes a storage constructed from the configuration.
+type StorageInfo struct {
+	Name   string `json:"name"`
+	Driver string `json:"driver"`
+	// Source is the configuration section used: local (kv.<name>.config), global
+	// (the section named after the storage), none, rpc for the storages added
+	// with kv.AddStorage, or composite for the storages built on other storages
+	Source string `json:"source"`
+	// ConfigKey is the key passed to the driver constructor, empty for the none source
+	ConfigKey string `json:"config_key"`
+}
+
+// SkippedStorage is a kv section Serve didn't construct a storage for.
+type SkippedStorage struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// StoragesResponse is the answer of the kv.Storages RPC call.
+type StoragesResponse struct {
+	Storages []*StorageInfo    `json:"storages"`
+	Skipped  []*SkippedStorage `json:"skipped"`
+}
+
+// AddStorageRequest is the payload of the kv.AddStorage RPC call.
+type AddStorageRequest struct {
+	Name   string `json:"name"`
+	Driver string `json:"driver"`
+	// ConfigKey is the configuration section the driver reads, for example redis.
+	// The drivers read their configuration only from the configuration sections,
+	// an inline driver configuration is not supported.
+	ConfigKey string   `json:"config_key,omitempty"`
+	Metadata  Metadata `json:"metadata,omitempty"`
+}
+
+// RemoveStorageRequest is the payload of the kv.RemoveStorage RPC call.
+type RemoveStorageRequest struct {
+	Name     string   `json:"name"`
+	Metadata Metadata `json:"metadata,omitempty"`
+}
+
+// Storages lists the configured storages, sorted by name, and the skipped sections.
+func (r *rpc) Storages(_ bool, out *StoragesResponse) error {
+	entries := r.pl.storages.snapshot()
+
+	out.Storages = make([]*StorageInfo, 0, len(entries))
+	for _, entry := range entries {
+		out.Storages = append(out.Storages, entry.info)
+	}
+	slices.SortFunc(out.Storages, func(a, b *StorageInfo) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	out.Skipped = slices.Clone(r.pl.storages.skippedSections())
+	slices.SortFunc(out.Skipped, func(a, b *SkippedStorage) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return nil
+}
+
+// AddStorage constructs a storage with the registered driver from the
+// configuration section under config_key and makes it available under the
+// requested name.
+func (r *rpc) AddStorage(in *AddStorageRequest, out *StorageInfo) error {
+	const op = errors.Op("rpc_add_storage")
+
+	ctx, span := r.tracer.Start(contextFrom(in.Metadata), "kv:add_storage")
+	defer span.End()
+
+	info, err := r.pl.addStorage(ctx, in)
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	*out = *info
+	return nil
+}
+
+// RemoveStorage unregisters the storage. It's stopped once the calls using it are
+// done. A storage declared in the configuration comes back on the next reload.
+func (r *rpc) RemoveStorage(in *RemoveStorageRequest, out *StorageInfo) error {
+	const op = errors.Op("rpc_remove_storage")
+
+	ctx, span := r.tracer.Start(contextFrom(in.Metadata), "kv:remove_storage")
+	defer span.End()
+
+	if in.Name == "" {
+		recordError(span, errEmptyStorage)
+		return withCode(errEmptyStorage)
+	}
+
+	r.pl.updateMu.Lock()
+	entry, err := r.pl.storages.unregister(ctx, in.Name)
+	r.pl.updateMu.Unlock()
+	if err != nil {
+		recordError(span, err)
+		return rpcError(op, err)
+	}
+
+	*out = *entry.info
+	return nil
+}
+
+func (p *Plugin) addStorage(ctx context.Context, in *AddStorageRequest) (*StorageInfo, error) {
+	if in.Name == "" {
+		return nil, errEmptyStorage
+	}
+
+	p.updateMu.Lock()
+	defer p.updateMu.Unlock()
+
+	if _, ok := p.storages.snapshot()[in.Name]; ok {
+		return nil, fmt.Errorf("%w: %s", errStorageExists, in.Name)
+	}
+
+	ctor, ok := p.constructors[in.Driver]
+	if !ok {
+		return nil, errors.Errorf("no such constructor was registered: %s", in.Driver)
+	}
+
+	st, err := ctor.KvFromConfig(ctx, in.ConfigKey)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &StorageInfo{
+		Name:      in.Name,
+		Driver:    in.Driver,
+		Source:    sourceRPC,
+		ConfigKey: in.ConfigKey,
+	}
+
+	if err := p.storages.register(newStorageEntry(st, info, defaultOptions(), nil)); err != nil {
+		st.Stop(ctx)
+		return nil, err
+	}
+
+	p.log.Info("storage registered", "storage", in.Name, "driver", in.Driver)
+	return info, nil
+}
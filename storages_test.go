@@ -0,0 +1,81 @@
+package kv
+
+import (
+	"testing"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRPCStorages(t *testing.T) {
+	p, _ := newInitedPlugin(t, map[string]any{
+		"north":  map[string]any{"driver": "fake"},
+		"south":  map[string]any{"driver": "fake"},
+		"east":   map[string]any{"driver": "fake"},
+		"empty":  nil,
+		"scalar": "not-a-map",
+		"number": map[string]any{"driver": 123},
+	}, map[string]bool{"kv.north.config": true, "south": true})
+	p.Collects()[0].Callback(&fakeConstructor{name: "fake"})
+	require.NoError(t, serveErr(p.Serve()))
+
+	r, ok := p.RPC().(*rpc)
+	require.True(t, ok)
+
+	var out StoragesResponse
+	require.NoError(t, r.Storages(true, &out))
+
+	assert.Equal(t, []*StorageInfo{
+		{Name: "east", Driver: "fake", Source: sourceNone},
+		{Name: "north", Driver: "fake", Source: sourceLocal, ConfigKey: "kv.north.config"},
+		{Name: "south", Driver: "fake", Source: sourceGlobal, ConfigKey: "south"},
+	}, out.Storages)
+
+	assert.Equal(t, []*SkippedStorage{
+		{Name: "empty", Reason: "empty section"},
+		{Name: "number", Reason: "driver field is not a string: int"},
+		{Name: "scalar", Reason: "wrong section type: string"},
+	}, out.Skipped)
+
+	require.NoError(t, p.Stop(t.Context()))
+	require.NoError(t, r.Storages(true, &out))
+	assert.Empty(t, out.Storages)
+	assert.Empty(t, out.Skipped)
+}
+
+func TestRPCAddRemoveStorage(t *testing.T) {
+	c := &mockCfg{
+		data: map[string]any{"north": map[string]any{"driver": "fake"}},
+		has:  map[string]bool{PluginName: true},
+	}
+	p, ctor := servedFake(t, c)
+
+	r, ok := p.RPC().(*rpc)
+	require.True(t, ok)
+
+	var info StorageInfo
+	require.NoError(t, r.AddStorage(&AddStorageRequest{Name: "south", Driver: "fake", ConfigKey: "redis"}, &info))
+	assert.Equal(t, StorageInfo{Name: "south", Driver: "fake", Source: sourceRPC, ConfigKey: "redis"}, info)
+	assert.Equal(t, []string{"", "redis"}, ctor.cfgKeys)
+
+	assert.ErrorContains(t, r.AddStorage(&AddStorageRequest{Name: "north", Driver: "fake"}, &info), errStorageExists.Error())
+	assert.ErrorContains(t, r.AddStorage(&AddStorageRequest{Name: "west", Driver: "nope"}, &info), "no such constructor")
+	assert.ErrorContains(t, r.AddStorage(&AddStorageRequest{Driver: "fake"}, &info), errEmptyStorage.Error())
+
+	require.NoError(t, r.Clear(&kvV1.Request{Storage: "south"}, &kvV1.Response{}))
+	assert.Equal(t, 1, ctor.created[1].recorded().clearCalls)
+
+	// runtime registrations survive a reload
+	var reloaded ReloadResponse
+	require.NoError(t, r.Reload(true, &reloaded))
+	assert.Equal(t, []string{"north", "south"}, reloaded.Unchanged)
+
+	require.NoError(t, r.RemoveStorage(&RemoveStorageRequest{Name: "south"}, &info))
+	assert.Equal(t, "south", info.Name)
+	assert.Equal(t, 1, ctor.created[1].recorded().stopCalls)
+	require.ErrorIs(t, r.Clear(&kvV1.Request{Storage: "south"}, &kvV1.Response{}), errNoSuchStore)
+
+	assert.ErrorContains(t, r.RemoveStorage(&RemoveStorageRequest{Name: "south"}, &info), errNoSuchStore.Error())
+	require.ErrorIs(t, r.RemoveStorage(&RemoveStorageRequest{}, &info), errEmptyStorage)
+}
@@ -0,0 +1,65 @@
+package kv
+
+import (
+	"context"
+	"hash/maphash"
+	"slices"
+	"sync"
+)
+
+// stripesCount is the number of mutexes the per-key locks are spread across
+const stripesCount int = 256
+
+// stripedMutex serializes the gateway-side read-modify-write fallbacks, which are
+// used for the drivers without native support of an operation. Keys are spread
+// across a fixed set of mutexes, so unrelated keys rarely contend. The lock is
+// process-wide: it doesn't protect from other RoadRunner instances sharing the
+// same backend.
+type stripedMutex struct {
+	seed    maphash.Seed
+	stripes [stripesCount]sync.Mutex
+}
+
+func newStripedMutex() *stripedMutex {
+	return &stripedMutex{seed: maphash.MakeSeed()}
+}
+
+func (s *stripedMutex) stripe(storage, key string) int {
+	var h maphash.Hash
+	h.SetSeed(s.seed)
+	_, _ = h.WriteString(storage)
+	_ = h.WriteByte(0)
+	_, _ = h.WriteString(key)
+
+	return int(h.Sum64() % uint64(stripesCount))
+}
+
+// lock acquires the stripes of all provided keys of the storage and returns the
+// function releasing them. Stripes are always taken in ascending order, so two
+// multi-key locks can't deadlock. The stripes are released right away when the
+// ctx is done once they are acquired: the caller waiting for them has given up.
+func (s *stripedMutex) lock(ctx context.Context, storage string, keys ...string) (func(), error) {
+	idx := make([]int, 0, len(keys))
+	for _, k := range keys {
+		idx = append(idx, s.stripe(storage, k))
+	}
+	slices.Sort(idx)
+	idx = slices.Compact(idx)
+
+	for _, i := range idx {
+		s.stripes[i].Lock()
+	}
+
+	unlock := func() {
+		for _, i := range slices.Backward(idx) {
+			s.stripes[i].Unlock()
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		unlock()
+		return nil, err
+	}
+
+	return unlock, nil
+}
@@ -129,7 +129,7 @@ func TestKVUnknownStorageOverRPC(t *testing.T) {
 		Items:   []*kvV1.Item{{Key: "key", Value: []byte("val")}},
 	}, &out)
 	require.Error(t, err)
-	assert.ErrorContains(t, err, "no such storage: ghost")
+	assert.ErrorContains(t, err, "[storage_not_found] no such storage: ghost")
 }
 
 func TestBoltReopenKeepsData(t *testing.T) {
@@ -0,0 +1,406 @@
+package kv
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/roadrunner-server/errors"
+)
+
+const (
+	// tieredDriver is the driver name of the near/far composite
+	tieredDriver string = "tiered"
+
+	// keys of the tiered section
+	tieredNear    string = "near"
+	tieredFar     string = "far"
+	tieredNearTTL string = "near_ttl"
+
+	// defaultNearTTL caps the near items when the near_ttl key is omitted
+	defaultNearTTL = time.Minute
+	// tieredGenerations is the number of the write generations the keys are spread
+	// across, see tiered.generation
+	tieredGenerations = 256
+)
+
+// tieredSpec is the section of a tiered storage:
+//
+//	kv:
+//	  local:
+//	    driver: memory
+//	    config: {}
+//	  remote:
+//	    driver: redis
+//	    config:
+//	      addrs:
+//	        - "127.0.0.1:6379"
+//	  users:
+//	    driver: tiered
+//	    near: local
+//	    far: remote
+//	    near_ttl: 1m
+type tieredSpec struct {
+	near, far string
+	// nearTTL caps the TTL of the items stored in the near tier
+	nearTTL time.Duration
+}
+
+func parseTiered(name string, section map[string]any) (compositeSpec, error) {
+	spec := &tieredSpec{nearTTL: defaultNearTTL}
+
+	for key, dst := range map[string]*string{
+		tieredNear: &spec.near,
+		tieredFar:  &spec.far,
+	} {
+		str, _ := section[key].(string)
+		if str == "" {
+			return nil, errors.Errorf("the %s storage should reference its %s tier by the storage name", name, key)
+		}
+		*dst = str
+	}
+
+	if spec.near == spec.far {
+		return nil, errors.Errorf("the near and far tiers of the %s storage should be different storages, got: %s", name, spec.near)
+	}
+
+	if v, ok := section[tieredNearTTL]; ok {
+		str, _ := v.(string)
+		d, err := time.ParseDuration(str)
+		if err != nil || d <= 0 {
+			return nil, errors.Errorf("wrong %s value in the %s storage: %v, should be a positive duration, for example 1m", tieredNearTTL, name, v)
+		}
+		spec.nearTTL = d
+	}
+
+	return spec, nil
+}
+
+func (s *tieredSpec) refs() []string {
+	return []string{s.near, s.far}
+}
+
+func (s *tieredSpec) build(env *compositeEnv, tiers []kv.Storage) (kv.Storage, error) {
+	return &tiered{
+		near:    tiers[0],
+		far:     tiers[1],
+		nearTTL: s.nearTTL,
+		log:     env.log,
+	}, nil
+}
+
+// tiered is a near/far composite, usually a fast local storage in front of a
+// shared one. Reads check the near tier first and fill it with the values found
+// in the far tier. Writes go to the far tier first and then to the near one;
+// when the near write fails, the keys are removed from the near tier, so that it
+// never serves the values overwritten in the far tier through this storage.
+// The far tier is the source of truth: TTL is answered by it, and the failures
+// of the near tier only cost the reads a round trip.
+//
+// A read racing with a write may load the value the write replaces. Writes bump
+// the generation of their keys before writing the far tier, and the fill skips
+// the keys whose generation changed since their far read, or removes them from
+// the near tier when it changed during the fill.
+type tiered struct {
+	stopNothing
+
+	near, far kv.Storage
+	nearTTL   time.Duration
+	log       *slog.Logger
+
+	// generations are bumped by the writes, the keys share them by their hash
+	generations [tieredGenerations]atomic.Uint64
+}
+
+// Has checks the near tier first. The keys it misses are loaded from the far tier,
+// filling the near one.
+func (t *tiered) Has(ctx context.Context, keys ...string) (map[string]bool, error) {
+	ret, err := t.near.Has(ctx, keys...)
+	if err != nil {
+		t.log.Warn("near tier has failed, falling back to the far tier", "error", err)
+		ret = make(map[string]bool, len(keys))
+	}
+
+	misses := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if !ret[k] {
+			misses = append(misses, k)
+		}
+	}
+
+	if len(misses) == 0 {
+		return ret, nil
+	}
+
+	found, err := t.load(ctx, misses)
+	if err != nil {
+		return nil, err
+	}
+
+	for k := range found {
+		ret[k] = true
+	}
+
+	return ret, nil
+}
+
+// Get checks the near tier first and fills it on miss.
+func (t *tiered) Get(ctx context.Context, key string) ([]byte, error) {
+	val, err := t.near.Get(ctx, key)
+	if err != nil {
+		t.log.Warn("near tier get failed, falling back to the far tier", "error", err)
+	}
+	if err == nil && val != nil {
+		return val, nil
+	}
+
+	gens := t.snapshot([]string{key})
+	val, err = t.far.Get(ctx, key)
+	if err != nil || val == nil {
+		return val, err
+	}
+
+	t.fill(ctx, map[string][]byte{key: val}, gens)
+	return val, nil
+}
+
+// MGet checks the near tier first, the keys it misses are loaded from the far tier,
+// filling the near one.
+func (t *tiered) MGet(ctx context.Context, keys ...string) (map[string][]byte, error) {
+	ret, err := t.near.MGet(ctx, keys...)
+	if err != nil {
+		t.log.Warn("near tier mget failed, falling back to the far tier", "error", err)
+		ret = make(map[string][]byte, len(keys))
+	}
+
+	misses := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if ret[k] == nil {
+			misses = append(misses, k)
+		}
+	}
+
+	if len(misses) == 0 {
+		return ret, nil
+	}
+
+	found, err := t.load(ctx, misses)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range found {
+		ret[k] = v
+	}
+
+	return ret, nil
+}
+
+// load reads the keys missed by the near tier from the far one and fills the near
+// tier with the found values.
+func (t *tiered) load(ctx context.Context, keys []string) (map[string][]byte, error) {
+	gens := t.snapshot(keys)
+	ret, err := t.far.MGet(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string][]byte, len(ret))
+	for k, v := range ret {
+		// drivers either omit the missing keys or report them with a nil value
+		if v != nil {
+			found[k] = v
+		}
+	}
+
+	t.fill(ctx, found, gens)
+	return found, nil
+}
+
+// fill stores the values loaded from the far tier in the near one, with the far
+// expiration capped by the near TTL. When the far expiration is unknown, the near
+// TTL is used, and without one the values are not stored at all. The keys written
+// since their generation was snapshotted are skipped.
+func (t *tiered) fill(ctx context.Context, values map[string][]byte, gens map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		if t.generation(k).Load() == gens[k] {
+			keys = append(keys, k)
+		}
+	}
+
+	if len(keys) == 0 {
+		return
+	}
+
+	limit := t.limit()
+	// drivers without TTL support (memcached) fail it, the timeouts are then empty
+	timeouts, err := t.far.TTL(ctx, keys...)
+	if err != nil && limit.IsZero() {
+		return
+	}
+
+	items := make([]kv.Item, 0, len(keys))
+	for _, k := range keys {
+		items = append(items, &Item{key: k, val: values[k], timeout: capTimeout(timeouts[k], limit)})
+	}
+
+	if err := t.near.Set(ctx, items...); err != nil {
+		t.log.Warn("failed to fill the near tier", "keys", len(items), "error", err)
+		return
+	}
+
+	// a write landing during the fill might have been overwritten by it
+	var stale []string
+	for _, k := range keys {
+		if t.generation(k).Load() != gens[k] {
+			stale = append(stale, k)
+		}
+	}
+
+	if len(stale) == 0 {
+		return
+	}
+
+	if err := t.near.Delete(ctx, stale...); err != nil {
+		t.log.Warn("failed to remove the stale values from the near tier", "keys", len(stale), "error", err)
+	}
+}
+
+// generation returns the write generation of the key.
+func (t *tiered) generation(key string) *atomic.Uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+
+	return &t.generations[h.Sum64()%tieredGenerations]
+}
+
+// snapshot returns the write generations of the keys.
+func (t *tiered) snapshot(keys []string) map[string]uint64 {
+	gens := make(map[string]uint64, len(keys))
+	for _, k := range keys {
+		gens[k] = t.generation(k).Load()
+	}
+
+	return gens
+}
+
+// written bumps the write generations of the keys, before they are written.
+func (t *tiered) written(keys ...string) {
+	for _, k := range keys {
+		t.generation(k).Add(1)
+	}
+}
+
+// Set writes through both tiers.
+func (t *tiered) Set(ctx context.Context, items ...kv.Item) error {
+	t.written(itemKeys(items)...)
+	if err := t.far.Set(ctx, items...); err != nil {
+		return err
+	}
+
+	return t.invalidateOnError(ctx, t.near.Set(ctx, t.capped(items)...), items)
+}
+
+// MExpire changes the expiration in both tiers, capped by the near TTL in the
+// near one.
+func (t *tiered) MExpire(ctx context.Context, items ...kv.Item) error {
+	t.written(itemKeys(items)...)
+	if err := t.far.MExpire(ctx, items...); err != nil {
+		return err
+	}
+
+	return t.invalidateOnError(ctx, t.near.MExpire(ctx, t.capped(items)...), items)
+}
+
+// TTL is answered by the far tier, the near one may hold shorter expirations.
+func (t *tiered) TTL(ctx context.Context, keys ...string) (map[string]string, error) {
+	return t.far.TTL(ctx, keys...)
+}
+
+// Delete removes the keys from both tiers.
+func (t *tiered) Delete(ctx context.Context, keys ...string) error {
+	t.written(keys...)
+	if err := t.far.Delete(ctx, keys...); err != nil {
+		return err
+	}
+
+	return t.near.Delete(ctx, keys...)
+}
+
+// Clear cleans both tiers.
+func (t *tiered) Clear(ctx context.Context) error {
+	for i := range t.generations {
+		t.generations[i].Add(1)
+	}
+
+	if err := t.far.Clear(ctx); err != nil {
+		return err
+	}
+
+	return t.near.Clear(ctx)
+}
+
+// invalidateOnError removes the written keys from the near tier when writing them
+// there failed, so that only the error of the removal reaches the caller.
+func (t *tiered) invalidateOnError(ctx context.Context, err error, items []kv.Item) error {
+	if err == nil {
+		return nil
+	}
+
+	keys := itemKeys(items)
+	t.log.Warn("near tier write failed, removing the keys from it", "keys", len(keys), "error", err)
+	return t.near.Delete(ctx, keys...)
+}
+
+// capped returns the items with the timeouts capped by the near TTL.
+func (t *tiered) capped(items []kv.Item) []kv.Item {
+	limit := t.limit()
+	if limit.IsZero() {
+		return items
+	}
+
+	ret := make([]kv.Item, 0, len(items))
+	for _, it := range items {
+		ret = append(ret, &Item{key: it.Key(), val: it.Value(), timeout: capTimeout(it.Timeout(), limit)})
+	}
+
+	return ret
+}
+
+// limit is the latest expiration of the near items, zero when it's not capped.
+func (t *tiered) limit() time.Time {
+	if t.nearTTL == 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(t.nearTTL)
+}
+
+// capTimeout returns the earlier of the RFC 3339 timeout (empty for no expiry)
+// and the limit, a zero limit meaning no cap.
+func capTimeout(timeout string, limit time.Time) string {
+	if limit.IsZero() {
+		return timeout
+	}
+
+	at, err := time.Parse(time.RFC3339, timeout)
+	if err != nil || at.After(limit) {
+		return formatTimeout(limit)
+	}
+
+	return timeout
+}
+
+// itemKeys returns the keys of the items.
+func itemKeys(items []kv.Item) []string {
+	keys := make([]string, 0, len(items))
+	for _, it := range items {
+		keys = append(keys, it.Key())
+	}
+
+	return keys
+}
@@ -0,0 +1,200 @@
+package kv
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const tieredStorage = "users"
+
+// newTieredRPC serves the users storage, a tiered one over two memStorages.
+func newTieredRPC(t *testing.T, section map[string]any) (*rpc, *memStorage, *memStorage) {
+	t.Helper()
+
+	section["driver"] = tieredDriver
+	section[tieredNear] = "local"
+	section[tieredFar] = "remote"
+
+	near, far := newMemStorage(), newMemStorage()
+	r, _, _ := newCompositeRPC(t, map[string]any{
+		"local":       map[string]any{"driver": "near"},
+		"remote":      map[string]any{"driver": "far"},
+		tieredStorage: section,
+	}, map[string]kv.Storage{"near": near, "far": far})
+
+	return r, near, far
+}
+
+func TestTieredReadFillsNearTier(t *testing.T) {
+	r, near, far := newTieredRPC(t, map[string]any{tieredNearTTL: "1m"})
+	farExpiry := formatTimeout(time.Now().Add(10 * time.Second))
+	far.put(firstKey, "a", farExpiry)
+	far.put(secondKey, "b", "")
+	near.put("gamma", "c", "")
+
+	var out MGetResponse
+	require.NoError(t, r.MGetDetailed(&KeysRequest{Storage: tieredStorage, Keys: []string{firstKey, secondKey, "gamma", "missing"}}, &out))
+	require.Len(t, out.Items, 4)
+	for i, want := range []string{"a", "b", "c"} {
+		assert.True(t, out.Items[i].Found)
+		assert.Equal(t, want, string(out.Items[i].Value))
+	}
+	assert.False(t, out.Items[3].Found)
+
+	// the far expiry is kept when it's earlier than the near TTL
+	it, ok := near.item(firstKey)
+	require.True(t, ok)
+	assert.Equal(t, farExpiry, it.timeout)
+
+	// the persistent far key expires in the near tier after the near TTL
+	it, ok = near.item(secondKey)
+	require.True(t, ok)
+	at, err := time.Parse(time.RFC3339, it.timeout)
+	require.NoError(t, err)
+	assert.InDelta(t, time.Minute.Seconds(), time.Until(at).Seconds(), 5)
+
+	_, ok = near.item("missing")
+	assert.False(t, ok)
+
+	// the near tier answers once filled
+	require.NoError(t, far.Delete(context.Background(), secondKey))
+	var has kvV1.Response
+	require.NoError(t, r.Has(&kvV1.Request{Storage: tieredStorage, Items: []*kvV1.Item{{Key: secondKey}}}, &has))
+	assert.Len(t, has.GetItems(), 1)
+}
+
+func TestTieredHasFillsNearTier(t *testing.T) {
+	r, near, far := newTieredRPC(t, map[string]any{})
+	far.put(firstKey, "a", "")
+
+	var out kvV1.Response
+	require.NoError(t, r.Has(&kvV1.Request{Storage: tieredStorage, Items: []*kvV1.Item{{Key: firstKey}, {Key: secondKey}}}, &out))
+	assert.Equal(t, []string{firstKey}, responseKeys(&out))
+
+	// without the near_ttl key, the persistent far key expires in the near tier
+	// after the default near TTL
+	it, ok := near.item(firstKey)
+	require.True(t, ok)
+	at, err := time.Parse(time.RFC3339, it.timeout)
+	require.NoError(t, err)
+	assert.InDelta(t, defaultNearTTL.Seconds(), time.Until(at).Seconds(), 5)
+}
+
+func TestTieredWritesThroughBothTiers(t *testing.T) {
+	r, near, far := newTieredRPC(t, map[string]any{tieredNearTTL: "1m"})
+
+	require.NoError(t, r.Set(&kvV1.Request{Storage: tieredStorage, Items: twoItems()}, &kvV1.Response{}))
+
+	for _, st := range []*memStorage{near, far} {
+		_, ok := st.item(firstKey)
+		assert.True(t, ok)
+		_, ok = st.item(secondKey)
+		assert.True(t, ok)
+	}
+
+	// the near tier caps the timeouts, TTL is answered by the far one
+	farItem, _ := far.item(firstKey)
+	nearItem, _ := near.item(firstKey)
+	assert.NotEqual(t, farItem.timeout, nearItem.timeout)
+
+	var ttl kvV1.Response
+	require.NoError(t, r.TTL(&kvV1.Request{Storage: tieredStorage, Items: []*kvV1.Item{{Key: firstKey}}}, &ttl))
+	require.Len(t, ttl.GetItems(), 1)
+	assert.Equal(t, farItem.timeout, ttl.GetItems()[0].GetTimeout())
+
+	require.NoError(t, r.MExpire(&kvV1.Request{Storage: tieredStorage, Items: []*kvV1.Item{{Key: secondKey, Timeout: rfc3339Expiry}}}, &kvV1.Response{}))
+	farItem, _ = far.item(secondKey)
+	nearItem, _ = near.item(secondKey)
+	at, err := time.Parse(time.RFC3339, farItem.timeout)
+	require.NoError(t, err)
+	assert.Equal(t, rfc3339Expiry, at.Format(time.RFC3339))
+	assert.NotEqual(t, farItem.timeout, nearItem.timeout)
+
+	require.NoError(t, r.Delete(&kvV1.Request{Storage: tieredStorage, Items: []*kvV1.Item{{Key: firstKey}}}, &kvV1.Response{}))
+	for _, st := range []*memStorage{near, far} {
+		_, ok := st.item(firstKey)
+		assert.False(t, ok)
+	}
+}
+
+func TestTieredInvalidatesNearTierOnFailedWrite(t *testing.T) {
+	far := newMemStorage()
+	near := &fakeStorage{err: assert.AnError}
+	st := &tiered{near: near, far: far, log: slog.New(&capHandler{})}
+
+	err := st.Set(context.Background(), &Item{key: firstKey, val: []byte("a")})
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Equal(t, []string{firstKey}, near.recorded().deleteKeys)
+
+	_, ok := far.item(firstKey)
+	assert.True(t, ok)
+
+	// the reads fall back to the far tier
+	val, err := st.Get(context.Background(), firstKey)
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(val))
+}
+
+// racingStorage runs the write once, right after its first MGet read the values.
+type racingStorage struct {
+	*memStorage
+	write func()
+}
+
+func (r *racingStorage) MGet(ctx context.Context, keys ...string) (map[string][]byte, error) {
+	ret, err := r.memStorage.MGet(ctx, keys...)
+	if r.write != nil {
+		r.write()
+		r.write = nil
+	}
+	return ret, err
+}
+
+func TestTieredSkipsStaleFill(t *testing.T) {
+	near, far := newMemStorage(), &racingStorage{memStorage: newMemStorage()}
+	far.put(firstKey, "v1", "")
+	st := &tiered{near: near, far: far, nearTTL: time.Minute, log: slog.New(&capHandler{})}
+	far.write = func() {
+		assert.NoError(t, st.Set(context.Background(), &Item{key: firstKey, val: []byte("v2")}))
+	}
+
+	ret, err := st.MGet(context.Background(), firstKey)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", string(ret[firstKey]))
+
+	// the value loaded before the write doesn't replace the written one
+	it, ok := near.item(firstKey)
+	require.True(t, ok)
+	assert.Equal(t, "v2", string(it.value))
+
+	val, err := st.Get(context.Background(), firstKey)
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(val))
+}
+
+func TestParseTiered(t *testing.T) {
+	cases := []struct {
+		name    string
+		section map[string]any
+		err     string
+	}{
+		{name: "missing near", section: map[string]any{"far": "b"}, err: "should reference its near tier"},
+		{name: "same tiers", section: map[string]any{"near": "a", "far": "a"}, err: "should be different storages"},
+		{name: "malformed near ttl", section: map[string]any{"near": "a", "far": "b", "near_ttl": "soon"}, err: "wrong near_ttl value"},
+		{name: "zero near ttl", section: map[string]any{"near": "a", "far": "b", "near_ttl": "0s"}, err: "should be a positive duration"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseTiered(tieredStorage, tc.section)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
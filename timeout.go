@@ -0,0 +1,143 @@
+package kv
+
+import (
+	"context"
+	stderr "errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// metadataTimeout is the Metadata key of the client timeout, a Go duration, for
+// example 250ms. It bounds the whole call, including the batched operations.
+const metadataTimeout string = "timeout"
+
+// maxOverdueCalls is the number of storage calls which are still running past
+// their deadline a storage tolerates. Over it, the calls fail right away instead
+// of piling up goroutines against a hung backend.
+const maxOverdueCalls int64 = 64
+
+var (
+	errClientTimeout = stderr.New("client timeout should be a positive duration")
+)
+
+// opClass groups the operations sharing the same storage timeout.
+type opClass int
+
+const (
+	// has, get, mget, ttl and scan
+	opRead opClass = iota
+	// set, mexpire, delete and the atomic operations
+	opWrite
+	// clear
+	opClear
+)
+
+// withClientTimeout bounds the ctx with the timeout found in the metadata. The
+// returned cancel function should be called once the call is done.
+func withClientTimeout(ctx context.Context, md Metadata) (context.Context, context.CancelFunc, error) {
+	var val string
+	for k, v := range md {
+		if strings.EqualFold(k, metadataTimeout) {
+			val = v
+			break
+		}
+	}
+
+	if val == "" {
+		return ctx, func() {}, nil
+	}
+
+	d, err := time.ParseDuration(val)
+	if err != nil || d <= 0 {
+		return nil, nil, fmt.Errorf("%w: %q", errClientTimeout, val)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d)
+	return ctx, cancel, nil
+}
+
+// bounded calls fn with the ctx bounded by the storage timeout of the operation
+// class. Drivers ignoring the ctx don't hold the caller past the deadline: fn is
+// left to finish in the background, holding the storage, and ErrTimeout is
+// returned right away. A timed-out write might still be applied by the storage.
+// Once maxOverdueCalls calls of the storage are left running, the next ones fail
+// with ErrUnavailable without calling the storage, until the overdue ones finish.
+func bounded[T any](ctx context.Context, e *storageEntry, class opClass, fn func(ctx context.Context) (T, error)) (T, error) {
+	timeout := e.opts.timeout(class)
+	// nothing can interrupt the call
+	if ctx.Done() == nil && timeout == 0 {
+		return fn(ctx)
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var zero T
+	if ctx.Err() != nil {
+		return zero, timeoutError(ctx, e)
+	}
+
+	type result struct {
+		val T
+		err error
+	}
+
+	if n := e.overdue.Load(); n >= maxOverdueCalls {
+		return zero, fmt.Errorf("%w: %s: %d calls are still running past their deadline", ErrUnavailable, e.info.Name, n)
+	}
+
+	// state is callRunning until either fn returns or the caller gives up on it
+	const (
+		callRunning int32 = iota
+		callFinished
+		callOverdue
+	)
+	var state atomic.Int32
+
+	done := make(chan result, 1)
+	e.hold()
+	go func() {
+		defer e.release()
+		val, err := fn(ctx)
+		if !state.CompareAndSwap(callRunning, callFinished) {
+			e.overdue.Add(-1)
+		}
+		done <- result{val: val, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil && ctx.Err() != nil && stderr.Is(res.err, ctx.Err()) {
+			return zero, timeoutError(ctx, e)
+		}
+		return res.val, res.err
+	case <-ctx.Done():
+		if state.CompareAndSwap(callRunning, callOverdue) {
+			e.overdue.Add(1)
+		}
+		return zero, timeoutError(ctx, e)
+	}
+}
+
+// boundedErr is bounded for the storage calls returning only an error.
+func boundedErr(ctx context.Context, e *storageEntry, class opClass, fn func(ctx context.Context) error) error {
+	_, err := bounded(ctx, e, class, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, fn(ctx)
+	})
+	return err
+}
+
+// timeoutError converts the error of the done ctx: an exceeded deadline becomes
+// ErrTimeout, a cancellation is returned as is.
+func timeoutError(ctx context.Context, e *storageEntry) error {
+	if stderr.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s", ErrTimeout, e.info.Name)
+	}
+
+	return ctx.Err()
+}
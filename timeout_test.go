@@ -0,0 +1,204 @@
+package kv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/roadrunner-server/api-plugins/v6/kv"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hangingStorage stands for an unresponsive backend: MGet and Set ignore the ctx
+// and block until unblock is closed, Has blocks until the ctx is done.
+type hangingStorage struct {
+	*memStorage
+	unblock chan struct{}
+}
+
+func (h *hangingStorage) MGet(ctx context.Context, keys ...string) (map[string][]byte, error) {
+	<-h.unblock
+	return h.memStorage.MGet(ctx, keys...)
+}
+
+func (h *hangingStorage) Set(ctx context.Context, items ...kv.Item) error {
+	<-h.unblock
+	return h.memStorage.Set(ctx, items...)
+}
+
+func (h *hangingStorage) Has(ctx context.Context, _ ...string) (map[string]bool, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func newHangingRPC(t *testing.T, timeouts map[string]any) (*rpc, *hangingStorage) {
+	t.Helper()
+
+	st := &hangingStorage{memStorage: newMemStorage(), unblock: make(chan struct{})}
+	section := map[string]any{"driver": "fake"}
+	if timeouts != nil {
+		section["timeouts"] = timeouts
+	}
+
+	r, _ := newRPCWithSection(t, st, section)
+	return r, st
+}
+
+func TestRPCStorageTimeout(t *testing.T) {
+	r, st := newHangingRPC(t, map[string]any{"read": "20ms"})
+
+	start := time.Now()
+	err := r.MGet(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &kvV1.Response{})
+	assert.ErrorContains(t, err, ErrTimeout.Error())
+	assert.Less(t, time.Since(start), time.Second)
+
+	// the driver honoring the ctx fails with the same error
+	err = r.Has(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &kvV1.Response{})
+	assert.ErrorContains(t, err, ErrTimeout.Error())
+
+	// the abandoned MGet holds the storage until the driver returns
+	entry, err := r.pl.storages.acquire(servedStorage)
+	require.NoError(t, err)
+	refs := func(n int) func() bool {
+		return func() bool {
+			entry.mu.Lock()
+			defer entry.mu.Unlock()
+			return entry.refs == n
+		}
+	}
+	assert.Eventually(t, refs(2), time.Second, 5*time.Millisecond)
+
+	close(st.unblock)
+	assert.Eventually(t, refs(1), time.Second, 5*time.Millisecond)
+	entry.release()
+
+	// write operations are not bounded by the read timeout
+	require.NoError(t, r.Set(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &kvV1.Response{}))
+}
+
+func TestRPCClientTimeout(t *testing.T) {
+	r, st := newHangingRPC(t, nil)
+	t.Cleanup(func() { close(st.unblock) })
+
+	var out BatchResponse
+	require.NoError(t, r.Batch(&BatchRequest{
+		Ops: []*BatchOp{
+			{Op: "mget", Storage: servedStorage, Items: twoItems()},
+			{Op: "set", Storage: servedStorage, Items: twoItems()},
+		},
+		Metadata: Metadata{"Timeout": "20ms"},
+	}, &out))
+
+	require.Len(t, out.Results, 2)
+	// the deadline covers the whole batch, so the operations after it fail too
+	for _, res := range out.Results {
+		assert.Contains(t, res.Error, ErrTimeout.Error())
+	}
+}
+
+func TestRPCClientTimeoutItem(t *testing.T) {
+	r, st := newHangingRPC(t, nil)
+	t.Cleanup(func() { close(st.unblock) })
+
+	// the kvV1 calls carry the deadline in a metadata item
+	items := append([]*kvV1.Item{{Key: metadataPrefix + "timeout", Value: []byte("20ms")}}, twoItems()...)
+
+	start := time.Now()
+	err := r.Set(&kvV1.Request{Storage: servedStorage, Items: items}, &kvV1.Response{})
+	assert.ErrorContains(t, err, ErrTimeout.Error())
+	assert.Equal(t, CodeTimeout, codeOf(err))
+	assert.Less(t, time.Since(start), time.Second)
+
+	items[0].Value = []byte("soon")
+	err = r.SetNX(&kvV1.Request{Storage: servedStorage, Items: items}, &kvV1.Response{})
+	assert.ErrorContains(t, err, errClientTimeout.Error())
+	assert.Equal(t, CodeInvalidArgument, codeOf(err))
+}
+
+func TestRPCLockWaitClientTimeout(t *testing.T) {
+	r, _ := newRPC(t, newMemStorage())
+
+	err := r.Lock(&LockRequest{
+		Storage:  servedStorage,
+		Resource: firstKey,
+		TTL:      "1m",
+		Metadata: Metadata{"timeout": "10ms"},
+	}, &LockResponse{})
+	require.NoError(t, err)
+
+	// a busy lock is awaited until the client timeout, not the requested wait
+	start := time.Now()
+	err = r.Lock(&LockRequest{
+		Storage:  servedStorage,
+		Resource: firstKey,
+		TTL:      "1m",
+		Wait:     "10s",
+		Metadata: Metadata{"timeout": "100ms"},
+	}, &LockResponse{})
+	assert.ErrorContains(t, err, ErrTimeout.Error())
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRPCClientTimeoutErrors(t *testing.T) {
+	r, _ := newRPC(t, newMemStorage())
+
+	for _, val := range []string{"soon", "-1s", "0s"} {
+		err := r.Increment(&CounterRequest{Storage: servedStorage, Key: firstKey, Metadata: Metadata{"timeout": val}}, &CounterResponse{})
+		assert.ErrorContains(t, err, errClientTimeout.Error(), val)
+	}
+
+	err := r.Batch(&BatchRequest{Metadata: Metadata{"timeout": "soon"}}, &BatchResponse{})
+	assert.ErrorContains(t, err, errClientTimeout.Error())
+}
+
+func TestBoundedWithoutTimeouts(t *testing.T) {
+	entry := newStorageEntry(newMemStorage(), &StorageInfo{Name: servedStorage}, defaultOptions(), nil)
+
+	// without any deadline or cancellation the call runs inline, no reference is taken
+	val, err := bounded(context.Background(), entry, opRead, func(context.Context) (int, error) {
+		entry.mu.Lock()
+		defer entry.mu.Unlock()
+		assert.Equal(t, 0, entry.refs)
+		return 42, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 42, val)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = bounded(ctx, entry, opRead, func(context.Context) (int, error) { return 0, nil })
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestBoundedOverdueCalls(t *testing.T) {
+	opts := defaultOptions()
+	opts.readTimeout = 5 * time.Millisecond
+	entry := newStorageEntry(newMemStorage(), &StorageInfo{Name: servedStorage}, opts, nil)
+
+	unblock := make(chan struct{})
+	hung := func(context.Context) (int, error) {
+		<-unblock
+		return 0, nil
+	}
+
+	for range maxOverdueCalls {
+		_, err := bounded(t.Context(), entry, opRead, hung)
+		require.ErrorIs(t, err, ErrTimeout)
+	}
+
+	// the hung backend isn't called anymore
+	_, err := bounded(t.Context(), entry, opRead, func(context.Context) (int, error) {
+		t.Error("the storage is called past the overdue calls limit")
+		return 0, nil
+	})
+	require.ErrorIs(t, err, ErrUnavailable)
+
+	close(unblock)
+	assert.Eventually(t, func() bool { return entry.overdue.Load() == 0 }, time.Second, 5*time.Millisecond)
+
+	val, err := bounded(t.Context(), entry, opRead, func(context.Context) (int, error) { return 42, nil })
+	require.NoError(t, err)
+	assert.Equal(t, 42, val)
+}
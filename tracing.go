@@ -0,0 +1,196 @@
+package kv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	stderr "errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// span attributes of the kv operations
+const (
+	attrStorage   = attribute.Key("kv.storage")
+	attrDriver    = attribute.Key("kv.driver")
+	attrKeyCount  = attribute.Key("kv.keys.count")
+	attrKeys      = attribute.Key("kv.keys")
+	attrHits      = attribute.Key("kv.hits")
+	attrBytes     = attribute.Key("kv.bytes")
+	attrErrorType = attribute.Key("error.type")
+	attrErrorCode = attribute.Key("kv.error.code")
+
+	// attributes of the failover storages
+	attrBreakerState = attribute.Key("kv.breaker.state")
+	attrBreakerFrom  = attribute.Key("kv.breaker.from")
+	attrRoute        = attribute.Key("kv.failover.route")
+)
+
+// maxSpanKeys limits the number of keys attached to a span
+const maxSpanKeys = 64
+
+// Metadata is the request metadata, the metadata field of the JSON RPC requests.
+// It carries the W3C trace context of the caller in the traceparent and
+// tracestate keys, so the kv spans become children of the caller span, and the
+// timeout of the call in the timeout key. The kvV1 requests carry it in reserved
+// items, see metadataPrefix.
+type Metadata map[string]string
+
+// metadataPrefix marks the items carrying the metadata of the kvV1 calls, whose
+// request has no field for it. The item key is the prefix followed by the
+// metadata key and the item value is the metadata value, for example
+// {"key": "@metadata:traceparent", "value": "00-..."}. These items never reach
+// the storage. The prefix is reserved: an item using it with a key which is not
+// a metadata key fails the call, instead of being taken for the metadata.
+const metadataPrefix string = "@metadata:"
+
+// metadataKeys are the keys the metadata items may carry, matched case-insensitively.
+var metadataKeys = []string{"traceparent", "tracestate", metadataTimeout}
+
+var errReservedKey = fmt.Errorf("%w: the %q key prefix is reserved for the metadata", ErrInvalidArgument, metadataPrefix)
+
+// requestMetadata returns the metadata found in the items of the kvV1 request
+// and the request without these items. The request is returned as is when it
+// carries no metadata.
+func requestMetadata(in *kvV1.Request) (*kvV1.Request, Metadata, error) {
+	var (
+		md    Metadata
+		items []*kvV1.Item
+	)
+
+	for i, it := range in.GetItems() {
+		key, ok := strings.CutPrefix(it.GetKey(), metadataPrefix)
+		if !ok {
+			if md != nil {
+				items = append(items, it)
+			}
+			continue
+		}
+
+		if !slices.ContainsFunc(metadataKeys, func(k string) bool { return strings.EqualFold(k, key) }) {
+			return nil, nil, fmt.Errorf("%w: %s", errReservedKey, it.GetKey())
+		}
+
+		if md == nil {
+			md = make(Metadata)
+			items = append(make([]*kvV1.Item, 0, len(in.GetItems())), in.GetItems()[:i]...)
+		}
+		md[key] = string(it.GetValue())
+	}
+
+	if md == nil {
+		return in, nil, nil
+	}
+
+	return &kvV1.Request{Storage: in.GetStorage(), Items: items}, md, nil
+}
+
+// requestContext returns the ctx carrying the remote span context found in the
+// metadata, unless the ctx already carries a span: the calls of a batch are the
+// children of the batch span.
+func requestContext(ctx context.Context, md Metadata) context.Context {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+
+	return extractTrace(ctx, md)
+}
+
+// traceContext is the W3C propagator. It's used instead of the global one, which
+// depends on the OTEL plugin configuration.
+var traceContext = propagation.TraceContext{}
+
+// contextFrom returns the background context carrying the remote span context
+// found in the metadata. The keys are matched case-insensitively, as HTTP headers.
+func contextFrom(md Metadata) context.Context {
+	return extractTrace(context.Background(), md)
+}
+
+func extractTrace(ctx context.Context, md Metadata) context.Context {
+	if len(md) == 0 {
+		return ctx
+	}
+
+	carrier := make(propagation.MapCarrier, len(md))
+	for k, v := range md {
+		carrier[strings.ToLower(k)] = v
+	}
+
+	return traceContext.Extract(ctx, carrier)
+}
+
+// traceKeys annotates the span with the number of keys and, depending on the
+// storage options, with the keys themselves or their hashes.
+func (e *storageEntry) traceKeys(span trace.Span, keys []string) {
+	span.SetAttributes(attrKeyCount.Int(len(keys)))
+	if e.opts.spanKeys == spanKeysNone || len(keys) == 0 {
+		return
+	}
+
+	listed := make([]string, 0, min(len(keys), maxSpanKeys))
+	for _, k := range keys[:min(len(keys), maxSpanKeys)] {
+		if e.opts.spanKeys == spanKeysHashed {
+			k = hashKey(k)
+		}
+		listed = append(listed, k)
+	}
+
+	span.SetAttributes(attrKeys.StringSlice(listed))
+}
+
+// hashKey returns the first 8 bytes of the key SHA-256, hex encoded. It's enough
+// to correlate the spans touching the same key without revealing it.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// recordError records the error as a span event together with its type, marks
+// the span failed and annotates it with the error code.
+func recordError(span trace.Span, err error) {
+	errType := errorType(err)
+	span.RecordError(err, trace.WithAttributes(attrErrorType.String(errType)))
+	span.SetAttributes(attrErrorType.String(errType), attrErrorCode.String(string(codeOf(err))))
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// recordError is recordError keeping the error message out of the span unless
+// the storage attaches the plain keys to the spans: the driver errors embed the
+// keys. The span gets the error type and code only.
+func (e *storageEntry) recordError(span trace.Span, err error) {
+	if e.opts.spanKeys == spanKeysPlain {
+		recordError(span, err)
+		return
+	}
+
+	errType, code := errorType(err), string(codeOf(err))
+	span.AddEvent("exception", trace.WithAttributes(
+		attribute.String("exception.type", errType),
+		attribute.String("exception.message", code),
+		attrErrorType.String(errType),
+	))
+	span.SetAttributes(attrErrorType.String(errType), attrErrorCode.String(code))
+	span.SetStatus(codes.Error, code)
+}
+
+// errorType returns the Go type of the first error in the chain which is not a
+// plain text or wrapping error, for example *net.OpError for a redis failure.
+func errorType(err error) string {
+	for e := err; e != nil; e = stderr.Unwrap(e) {
+		switch t := fmt.Sprintf("%T", e); t {
+		case "*errors.errorString", "*fmt.wrapError":
+			continue
+		default:
+			return t
+		}
+	}
+
+	return fmt.Sprintf("%T", err)
+}
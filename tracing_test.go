@@ -0,0 +1,228 @@
+package kv
+
+import (
+	stderr "errors"
+	"fmt"
+	"testing"
+
+	kvV1 "github.com/roadrunner-server/api-go/v6/kv/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	callerTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	callerSpanID  = "00f067aa0ba902b7"
+	traceparent   = "00-" + callerTraceID + "-" + callerSpanID + "-01"
+)
+
+func TestContextFrom(t *testing.T) {
+	cases := []struct {
+		name   string
+		md     Metadata
+		remote bool
+	}{
+		{name: "no metadata", md: nil},
+		{name: "malformed traceparent", md: Metadata{"traceparent": "00-garbage"}},
+		{name: "traceparent", md: Metadata{"traceparent": traceparent}, remote: true},
+		{name: "header-cased keys", md: Metadata{"Traceparent": traceparent, "Tracestate": "rr=kv"}, remote: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sc := trace.SpanContextFromContext(contextFrom(tc.md))
+			if !tc.remote {
+				assert.False(t, sc.IsValid())
+				return
+			}
+
+			assert.True(t, sc.IsRemote())
+			assert.Equal(t, callerTraceID, sc.TraceID().String())
+			assert.Equal(t, callerSpanID, sc.SpanID().String())
+			if state, ok := tc.md["Tracestate"]; ok {
+				assert.Equal(t, state, sc.TraceState().String())
+			}
+		})
+	}
+}
+
+func TestRPCSpansContinueCallerTrace(t *testing.T) {
+	st := newMemStorage()
+	r, rec := newRPC(t, st)
+
+	md := Metadata{"traceparent": traceparent}
+	require.NoError(t, r.Batch(&BatchRequest{
+		Ops:      []*BatchOp{{Op: "set", Storage: servedStorage, Items: []*kvV1.Item{{Key: firstKey, Value: []byte("a")}}}},
+		Metadata: md,
+	}, &BatchResponse{}))
+	require.NoError(t, r.Lock(&LockRequest{Storage: servedStorage, Resource: firstKey, TTL: "30s", Metadata: md}, &LockResponse{}))
+	require.NoError(t, r.Increment(&CounterRequest{Storage: servedStorage, Key: secondKey, Metadata: md}, &CounterResponse{}))
+
+	ended := rec.Ended()
+	require.Len(t, ended, 4)
+
+	for i, name := range []string{"kv:batch", "kv:lock", "kv:increment"} {
+		span := ended[i+1]
+		assert.Equal(t, name, span.Name())
+		assert.Equal(t, callerTraceID, span.SpanContext().TraceID().String())
+		assert.Equal(t, callerSpanID, span.Parent().SpanID().String())
+		assert.True(t, span.Parent().IsRemote())
+	}
+	// the operation of the batch stays a child of the batch span
+	assert.Equal(t, ended[1].SpanContext().SpanID(), ended[0].Parent().SpanID())
+}
+
+func TestRPCSpansWithoutMetadataAreRoots(t *testing.T) {
+	r, rec := newRPC(t, newMemStorage())
+
+	require.NoError(t, r.Increment(&CounterRequest{Storage: servedStorage, Key: firstKey}, &CounterResponse{}))
+
+	ended := rec.Ended()
+	require.Len(t, ended, 1)
+	assert.False(t, ended[0].Parent().IsValid())
+}
+
+// spanAttrs returns the attributes of the span keyed by name.
+func spanAttrs(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value, len(span.Attributes()))
+	for _, a := range span.Attributes() {
+		attrs[a.Key] = a.Value
+	}
+
+	return attrs
+}
+
+func TestRPCSpanAttributes(t *testing.T) {
+	st := newMemStorage()
+	st.put(firstKey, "abc", "")
+	r, rec := newRPC(t, st)
+
+	require.NoError(t, r.MGet(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &kvV1.Response{}))
+
+	ended := rec.Ended()
+	require.Len(t, ended, 1)
+
+	attrs := spanAttrs(ended[0])
+	assert.Equal(t, servedStorage, attrs[attrStorage].AsString())
+	assert.Equal(t, "fake", attrs[attrDriver].AsString())
+	assert.Equal(t, int64(2), attrs[attrKeyCount].AsInt64())
+	assert.Equal(t, int64(1), attrs[attrHits].AsInt64())
+	assert.Equal(t, int64(3), attrs[attrBytes].AsInt64())
+	// the keys are redacted by default
+	assert.NotContains(t, attrs, attrKeys)
+}
+
+func TestRPCSpanKeys(t *testing.T) {
+	cases := []struct {
+		mode string
+		keys []string
+	}{
+		{mode: spanKeysNone},
+		{mode: spanKeysHashed, keys: []string{hashKey(firstKey), hashKey(secondKey)}},
+		{mode: spanKeysPlain, keys: []string{firstKey, secondKey}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.mode, func(t *testing.T) {
+			r, rec := newRPCWithSection(t, newMemStorage(), map[string]any{
+				"driver":  "fake",
+				"tracing": map[string]any{"keys": tc.mode},
+			})
+
+			require.NoError(t, r.Delete(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &kvV1.Response{}))
+
+			ended := rec.Ended()
+			require.Len(t, ended, 1)
+
+			attrs := spanAttrs(ended[0])
+			assert.Equal(t, int64(2), attrs[attrKeyCount].AsInt64())
+			if tc.keys == nil {
+				assert.NotContains(t, attrs, attrKeys)
+				return
+			}
+			assert.Equal(t, tc.keys, attrs[attrKeys].AsStringSlice())
+		})
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	assert.Len(t, hashKey(firstKey), 16)
+	assert.Equal(t, hashKey(firstKey), hashKey(firstKey))
+	assert.NotEqual(t, hashKey(firstKey), hashKey(secondKey))
+	assert.NotContains(t, hashKey(firstKey), firstKey)
+}
+
+// driverError stands for a typed error returned by a storage driver.
+type driverError struct{}
+
+func (driverError) Error() string { return "connection refused" }
+
+func TestRPCSpanErrorType(t *testing.T) {
+	cases := []struct {
+		name    string
+		err     error
+		errType string
+	}{
+		{name: "typed error", err: driverError{}, errType: "kv.driverError"},
+		{name: "wrapped typed error", err: fmt.Errorf("dial: %w", driverError{}), errType: "kv.driverError"},
+		{name: "plain error", err: stderr.New("oops"), errType: "*errors.errorString"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, rec := newRPC(t, &fakeStorage{err: tc.err})
+
+			require.Error(t, r.Has(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &kvV1.Response{}))
+
+			ended := rec.Ended()
+			require.Len(t, ended, 1)
+			assert.Equal(t, codes.Error, ended[0].Status().Code)
+			assert.Equal(t, tc.errType, spanAttrs(ended[0])[attrErrorType].AsString())
+
+			events := ended[0].Events()
+			require.Len(t, events, 1)
+			assert.Contains(t, events[0].Attributes, attrErrorType.String(tc.errType))
+		})
+	}
+}
+
+func TestRPCSpanErrorMessage(t *testing.T) {
+	keyErr := fmt.Errorf("%w: wrong value of the %s key", ErrInvalidArgument, firstKey)
+
+	for _, mode := range []string{spanKeysNone, spanKeysHashed, spanKeysPlain} {
+		t.Run(mode, func(t *testing.T) {
+			r, rec := newRPCWithSection(t, &fakeStorage{err: keyErr}, map[string]any{
+				"driver":  "fake",
+				"tracing": map[string]any{"keys": mode},
+			})
+
+			require.Error(t, r.Has(&kvV1.Request{Storage: servedStorage, Items: twoItems()}, &kvV1.Response{}))
+
+			ended := rec.Ended()
+			require.Len(t, ended, 1)
+			events := ended[0].Events()
+			require.Len(t, events, 1)
+			message := ""
+			for _, attr := range events[0].Attributes {
+				if attr.Key == "exception.message" {
+					message = attr.Value.AsString()
+				}
+			}
+
+			if mode == spanKeysPlain {
+				assert.Equal(t, keyErr.Error(), ended[0].Status().Description)
+				assert.Equal(t, keyErr.Error(), message)
+				return
+			}
+
+			// the keys embedded in the error don't reach the span
+			assert.Equal(t, string(CodeInvalidArgument), ended[0].Status().Description)
+			assert.Equal(t, string(CodeInvalidArgument), message)
+			assert.Equal(t, string(CodeInvalidArgument), spanAttrs(ended[0])[attrErrorCode].AsString())
+		})
+	}
+}